@@ -0,0 +1,442 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"zham-app/config"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/wav"
+)
+
+// batchWriteSize is how many fingerprinted songs a batch ingest collects
+// before writing them to the store in one Put.
+const batchWriteSize = 16
+
+// audioExts are the files picked up when a batch ingests a directory.
+var audioExts = map[string]bool{
+	".wav": true, ".mp3": true, ".flac": true, ".ogg": true, ".m4a": true, ".aac": true,
+}
+
+// batchEntry is one song of a batch manifest. File is relative to the
+// manifest, the other fields match the form fields of PUT /zham.
+type batchEntry struct {
+	File      string
+	SongId    string
+	Title     string
+	Artist    string
+	Album     string
+	SourceUrl string
+}
+
+// BatchFileResult is the outcome of one file of a batch ingest.
+type BatchFileResult struct {
+	File       string
+	SongId     string
+	Addresses  int
+	DurationMs int64
+	Error      string
+}
+
+type BatchReport struct {
+	Files      []BatchFileResult
+	Ingested   int
+	Failed     int
+	DurationMs int64
+}
+
+// listBatch returns the songs to ingest from path, either a directory whose
+// audio files are ingested under their base name or a JSON manifest listing
+// batchEntry values.
+func listBatch(path string) ([]batchEntry, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entries []batchEntry
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		for i := range entries {
+			if !filepath.IsAbs(entries[i].File) {
+				entries[i].File = filepath.Join(filepath.Dir(path), entries[i].File)
+			}
+			if entries[i].SongId == "" {
+				entries[i].SongId = songIdFromPath(entries[i].File)
+			}
+		}
+		return entries, nil
+	}
+
+	var entries []batchEntry
+	err = filepath.WalkDir(path, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !audioExts[strings.ToLower(filepath.Ext(p))] {
+			return nil
+		}
+		entries = append(entries, batchEntry{File: p, SongId: songIdFromPath(p)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func songIdFromPath(path string) string {
+	return strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+}
+
+// fingerprintedSong is what a batch worker hands to the writer.
+type fingerprintedSong struct {
+	index        int
+	song         models.Song
+	fingerprints map[uint32][]models.Couple
+	err          error
+}
+
+// ingestBatch fingerprints entries on a worker pool sized to GOMAXPROCS and
+// writes the results to the store batchWriteSize songs at a time. Catalogued
+// songs are only re-ingested with replace set. progress, if not nil, is
+// called from a single goroutine as every file finishes.
+func ingestBatch(cfg *config.Config, store db.Store, songs *db.SongStore, entries []batchEntry, replace bool, progress func(done int, total int, res BatchFileResult)) BatchReport {
+	startTime := time.Now()
+
+	report := BatchReport{Files: make([]BatchFileResult, len(entries))}
+	done := 0
+	finish := func(i int, err error) {
+		res := &report.Files[i]
+		if err != nil {
+			res.Error = err.Error()
+			report.Failed++
+		} else {
+			report.Ingested++
+		}
+		done++
+		if progress != nil {
+			progress(done, len(entries), *res)
+		}
+	}
+
+	// reject duplicates and conflicts up front so no work is wasted on them
+	seen := map[string]bool{}
+	var todo []int
+	for i, entry := range entries {
+		report.Files[i] = BatchFileResult{File: entry.File, SongId: entry.SongId}
+		switch {
+		case entry.SongId == "":
+			finish(i, errors.New("missing SongId"))
+		case seen[entry.SongId]:
+			finish(i, fmt.Errorf("song %s appears more than once in the batch", entry.SongId))
+		default:
+			seen[entry.SongId] = true
+			if err := checkReplace(songs, entry.SongId, replace); err != nil {
+				finish(i, err)
+				continue
+			}
+			todo = append(todo, i)
+		}
+	}
+
+	jobs := make(chan int)
+	results := make(chan fingerprintedSong)
+
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				fileStart := time.Now()
+				song, fingerprints, err := fingerprintEntry(cfg, entries[i])
+				report.Files[i].DurationMs = time.Since(fileStart).Milliseconds()
+				report.Files[i].Addresses = len(fingerprints)
+				results <- fingerprintedSong{index: i, song: song, fingerprints: fingerprints, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for _, i := range todo {
+			jobs <- i
+		}
+		close(jobs)
+		wg.Wait()
+		close(results)
+	}()
+
+	var pending []fingerprintedSong
+	flush := func() {
+		if len(pending) == 0 {
+			return
+		}
+		err := writeBatch(cfg, store, songs, pending, replace)
+		for _, p := range pending {
+			if p.err != nil {
+				finish(p.index, p.err)
+			} else {
+				finish(p.index, err)
+			}
+		}
+		pending = pending[:0]
+	}
+
+	for res := range results {
+		if res.err != nil {
+			finish(res.index, res.err)
+			continue
+		}
+		pending = append(pending, res)
+		if len(pending) >= batchWriteSize {
+			flush()
+		}
+	}
+	flush()
+
+	report.DurationMs = time.Since(startTime).Milliseconds()
+	return report
+}
+
+func fingerprintEntry(cfg *config.Config, entry batchEntry) (models.Song, map[uint32][]models.Couple, error) {
+	samples, rate, err := wav.DecodeFile(entry.File)
+	if err != nil {
+		return models.Song{}, nil, err
+	}
+	samples, err = cfg.Fingerprint.Resample(samples, rate)
+	if err != nil {
+		return models.Song{}, nil, err
+	}
+
+	fingerprints, _, err := fingerprintSamples(cfg, samples, entry.SongId)
+	if err != nil {
+		return models.Song{}, nil, err
+	}
+
+	song := models.Song{
+		ID:          entry.SongId,
+		Title:       entry.Title,
+		Artist:      entry.Artist,
+		Album:       entry.Album,
+		SourceURL:   entry.SourceUrl,
+		DurationSec: float64(len(samples)) / float64(cfg.Fingerprint.SampleRate),
+	}
+	return song, fingerprints, nil
+}
+
+// writeBatch stores the couples of several songs with a single Put, then
+// catalogues them with a single write. Like storeSong it checks every song
+// again under its lock; the err of a song catalogued meanwhile is set and
+// the song skipped. The purge of replaced songs and the Put happen under the
+// locks too, and if the Put fails the purged songs are uncatalogued.
+func writeBatch(cfg *config.Config, store db.Store, songs *db.SongStore, batch []fingerprintedSong, replace bool) error {
+	ids := make([]string, len(batch))
+	for i, b := range batch {
+		ids[i] = b.song.ID
+	}
+	unlock := ingestLocks.lock(ids...)
+	defer unlock()
+
+	all := map[uint32][]models.Couple{}
+	catalogue := make([]models.Song, 0, len(batch))
+	var purged []string
+	for i, b := range batch {
+		if err := checkReplace(songs, b.song.ID, replace); err != nil {
+			batch[i].err = err
+			continue
+		}
+		if replace {
+			if err := purgeSong(cfg, store, b.song.ID); err != nil {
+				return dropPurged(songs, err, purged...)
+			}
+			purged = append(purged, b.song.ID)
+		}
+		for address, couples := range b.fingerprints {
+			all[address] = append(all[address], couples...)
+		}
+		catalogue = append(catalogue, b.song)
+	}
+
+	if err := store.Put(all); err != nil {
+		return dropPurged(songs, err, purged...)
+	}
+	return songs.PutMany(catalogue)
+}
+
+// resolveBatchPath resolves path against root and refuses anything outside
+// it, so POST /zham/batch can't be pointed at arbitrary server files. Both are
+// compared with their symlinks resolved, so a link under the root can't lead
+// out of it. An empty root refuses every path.
+func resolveBatchPath(root string, path string) (string, error) {
+	if root == "" {
+		return "", &apiError{status: http.StatusForbidden, err: errors.New("reading files on the server is disabled, see server.batchRoot")}
+	}
+
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	realRoot, err := filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return "", err
+	}
+
+	abs := filepath.Join(absRoot, path)
+	if filepath.IsAbs(path) {
+		abs = filepath.Clean(path)
+	}
+	real, err := evalSymlinks(abs)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", badRequest(fmt.Errorf("%s does not exist", path))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", badRequest(fmt.Errorf("%s is outside the batch root", path))
+	}
+	return real, nil
+}
+
+// evalSymlinks is filepath.EvalSymlinks allowing the last element to be
+// missing, so a manifest listing a missing file fails for that file only.
+func evalSymlinks(path string) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if !errors.Is(err, os.ErrNotExist) {
+		return real, err
+	}
+	if _, lerr := os.Lstat(path); lerr == nil {
+		// a dangling link, its target is unknown
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+// ingestBatchHandler ingests a directory or manifest on the server, given as
+// {"Path": ..., "Replace": ...} relative to the configured batch root, and
+// answers with the BatchReport once every file is done.
+func ingestBatchHandler(cfg *config.Config, store db.Store, songs *db.SongStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Path    string
+			Replace bool
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+		if body.Path == "" {
+			writeError(w, badRequest(errors.New("missing Path")))
+			return
+		}
+
+		path, err := resolveBatchPath(cfg.Server.BatchRoot, body.Path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		entries, err := listBatch(path)
+		if errors.Is(err, os.ErrNotExist) {
+			writeError(w, badRequest(fmt.Errorf("%s does not exist", body.Path)))
+			return
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		// a manifest may only list files under the root too
+		for _, entry := range entries {
+			if _, err := resolveBatchPath(cfg.Server.BatchRoot, entry.File); err != nil {
+				writeError(w, err)
+				return
+			}
+		}
+
+		report := ingestBatch(cfg, store, songs, entries, body.Replace, logBatchProgress)
+
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+func logBatchProgress(done int, total int, res BatchFileResult) {
+	if res.Error != "" {
+		fmt.Printf("[%d/%d] %s: failed: %s\n", done, total, res.File, res.Error)
+		return
+	}
+	fmt.Printf("[%d/%d] %s: %s, %d addresses in %dms\n", done, total, res.File, res.SongId, res.Addresses, res.DurationMs)
+}
+
+func runBatch(args []string) error {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+	replace := fs.Bool("replace", false, "re-ingest songs that are already catalogued")
+	loader := config.NewLoader(fs)
+
+	paths := parseArgs(fs, args)
+	if len(paths) != 1 {
+		return errors.New("usage: zham batch <dir|manifest.json>")
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	entries, err := listBatch(paths[0])
+	if err != nil {
+		return err
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report := ingestBatch(cfg, store, songs, entries, *replace, logBatchProgress)
+
+	fmt.Printf("Ingested %d of %d files in %v, %d failed\n",
+		report.Ingested, len(entries), time.Duration(report.DurationMs)*time.Millisecond, report.Failed)
+
+	var failed []string
+	for _, res := range report.Files {
+		if res.Error != "" {
+			failed = append(failed, fmt.Sprintf("  %s: %s", res.File, res.Error))
+		}
+	}
+	sort.Strings(failed)
+	for _, f := range failed {
+		fmt.Println(f)
+	}
+
+	if report.Failed > 0 {
+		return fmt.Errorf("%d files failed", report.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"zham-app/config"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/wav"
+	"zham-app/zham"
+)
+
+// commands are the subcommands of the zham binary, run as `zham <command>
+// [flags]`. Without a command the binary serves the HTTP API. The server
+// keeps its index in memory, so it only sees changes made by a command after
+// a restart.
+var commands = map[string]func(args []string) error{
+	"ingest":  runIngest,
+	"batch":   runBatch,
+	"query":   runQuery,
+	"stats":   runStats,
+	"delete":  runDelete,
+	"migrate": runMigrate,
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: zham [command] [flags]
+
+Without a command zham serves the HTTP API on the configured server.port.
+
+commands:
+  ingest <file> --id ID   fingerprint a file and add it to the store
+  batch <dir|manifest>    ingest every audio file of a directory or manifest
+  query <file>            match a file against the store
+  stats                   print store and catalogue sizes
+  delete <id>             remove a song from the store and catalogue
+  migrate                 import the db*.json shards into the store
+
+Run zham <command> -h for the flags of a command.
+`)
+}
+
+// parseArgs parses args allowing flags after the positional arguments, as in
+// `zham ingest song.wav --id X`, and returns the positional ones.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		if fs.NArg() == 0 {
+			return positional
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func runIngest(args []string) error {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	id := fs.String("id", "", "song ID (required)")
+	title := fs.String("title", "", "song title")
+	artist := fs.String("artist", "", "song artist")
+	album := fs.String("album", "", "song album")
+	sourceURL := fs.String("source-url", "", "where the song comes from")
+	replace := fs.Bool("replace", false, "re-ingest a song that is already catalogued")
+	loader := config.NewLoader(fs)
+
+	files := parseArgs(fs, args)
+	if len(files) != 1 || *id == "" {
+		return errors.New("usage: zham ingest <file> --id ID")
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if _, exists := songs.Get(*id); exists && !*replace {
+		return fmt.Errorf("song %s already exists, pass --replace to re-ingest it", *id)
+	}
+
+	startTime := time.Now()
+
+	samples, rate, err := wav.DecodeFile(files[0])
+	if err != nil {
+		return err
+	}
+	samples, err = cfg.Fingerprint.Resample(samples, rate)
+	if err != nil {
+		return err
+	}
+
+	fingerprints, _, err := fingerprintSamples(cfg, samples, *id)
+	if err != nil {
+		return err
+	}
+
+	song := models.Song{
+		ID:          *id,
+		Title:       *title,
+		Artist:      *artist,
+		Album:       *album,
+		SourceURL:   *sourceURL,
+		DurationSec: float64(len(samples)) / float64(cfg.Fingerprint.SampleRate),
+	}
+	if err := storeSong(cfg, store, songs, song, fingerprints, *replace); err != nil {
+		return err
+	}
+
+	fmt.Printf("Ingested %s as %s: %.1fs of audio, %d addresses in %v\n",
+		files[0], *id, song.DurationSec, len(fingerprints), time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
+func runQuery(args []string) error {
+	fs := flag.NewFlagSet("query", flag.ExitOnError)
+	loader := config.NewLoader(fs)
+
+	files := parseArgs(fs, args)
+	if len(files) != 1 {
+		return errors.New("usage: zham query <file>")
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	startTime := time.Now()
+
+	samples, rate, err := wav.DecodeFile(files[0])
+	if err != nil {
+		return err
+	}
+	samples, err = cfg.Fingerprint.Resample(samples, rate)
+	if err != nil {
+		return err
+	}
+
+	fingerprints, numTargetZones, err := fingerprintSamples(cfg, samples, "")
+	if err != nil {
+		return err
+	}
+
+	matches, err := findMatches(cfg, store, fingerprints, numTargetZones)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%d candidates in %v\n", len(matches), time.Since(startTime).Round(time.Millisecond))
+	if len(matches) == 0 {
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tSONG\tTITLE\tSCORE\tZ\tALIGNED\tOFFSET\tCONFIDENT")
+	for i, m := range matches {
+		song, _ := songs.Get(m.SongID)
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%.3f\t%.2f\t%d\t%.2fs\t%v\n",
+			i+1, m.SongID, song.Title, m.Score, m.Z, m.AlignedHashes, m.OffsetSec, m.Confident)
+	}
+	return tw.Flush()
+}
+
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	loader := config.NewLoader(fs)
+	fs.Parse(args)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	startTime := time.Now()
+	index, err := db.NewIndex(store)
+	if err != nil {
+		return err
+	}
+	stats := index.Stats()
+
+	fmt.Printf("Store:     %s\n", cfg.Store.Backend)
+	fmt.Printf("Songs:     %d in the store, %d catalogued\n", stats.Songs, len(songs.All()))
+	fmt.Printf("Addresses: %d\n", stats.Addresses)
+	fmt.Printf("Couples:   %d\n", stats.Couples)
+	fmt.Printf("Index:     %.1f MB, loaded in %v\n", float64(stats.Bytes)/1024/1024, time.Since(startTime).Round(time.Millisecond))
+	return nil
+}
+
+func runDelete(args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ExitOnError)
+	loader := config.NewLoader(fs)
+
+	ids := parseArgs(fs, args)
+	if len(ids) != 1 {
+		return errors.New("usage: zham delete <id>")
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if err := removeSong(cfg, store, songs, ids[0]); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted %s\n", ids[0])
+	return nil
+}
+
+// runMigrate imports the db*.json shards into the configured store and adds a
+// catalogue entry for every imported song that doesn't have one yet.
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	shardDir := fs.String("shards", ".", "directory holding the db*.json shards")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, `usage: zham migrate [flags]
+
+The shards were fingerprinted with the legacy profile, which resamples with
+ffmpeg. The migrated store keeps it, so serving it needs ffmpeg installed and
+starts an ffmpeg process for every upload, query and live session whose audio
+isn't at 48kHz. Re-ingest into a new store to move to the default profile.
+
+flags:
+`)
+		fs.PrintDefaults()
+	}
+	loader := config.NewLoader(fs)
+	fs.Parse(args)
+
+	cfg, err := loader.Load()
+	if err != nil {
+		return err
+	}
+	if cfg.Store.Backend == db.BackendJSON {
+		return errors.New("migrate: the json backend reads the shards themselves, pick another -store.backend")
+	}
+	// the shards predate profiles and were all made with the legacy one
+	cfg.Fingerprint = cfg.Fingerprint.WithDefaults(zham.LegacyProfile())
+	if cfg.Fingerprint != zham.LegacyProfile() {
+		return fmt.Errorf("migrate: the shards hold %s fingerprints, not %s; run it with -fingerprint.version 1 -fingerprint.resampler %s",
+			zham.LegacyProfile().ID(), cfg.Fingerprint.ID(), zham.ResamplerFFmpeg)
+	}
+
+	shards, err := db.FindJSONShards(*shardDir)
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("migrate: no db*.json shards in %s", *shardDir)
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	report, err := db.MigrateJSONShards(shards, store)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]string, 0, len(report.Songs))
+	for id := range report.Songs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var missing []models.Song
+	for _, id := range ids {
+		if _, ok := songs.Get(id); !ok {
+			missing = append(missing, models.Song{ID: id})
+		}
+	}
+	if err := songs.PutMany(missing); err != nil {
+		return err
+	}
+
+	fmt.Printf("Migrated %s into the %s store\n", strings.Join(shards, ", "), cfg.Store.Backend)
+	for _, id := range ids {
+		fmt.Printf("  %-24s %d couples\n", id, report.Songs[id])
+	}
+	fmt.Printf("Duplicate couples dropped: %d\n", report.Duplicates)
+	fmt.Printf("Malformed entries skipped: %d\n", len(report.Malformed))
+	for _, m := range report.Malformed {
+		fmt.Printf("  %s address %d: %q\n", m.Shard, m.Address, m.Entry)
+	}
+	if len(report.Skipped) > 0 {
+		fmt.Printf("Songs already in the store, not migrated: %s\n", strings.Join(report.Skipped, ", "))
+	}
+
+	return nil
+}
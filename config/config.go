@@ -0,0 +1,114 @@
+// Package config gathers the server and pipeline settings. Every setting has
+// a default and can be overridden, in increasing order of precedence, by a
+// JSON or YAML config file, a ZHAM_* environment variable and a flag.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"zham-app/db"
+	"zham-app/zham"
+)
+
+type Config struct {
+	Server ServerConfig
+	// Fingerprint is recorded with the store, see zham.CheckProfile.
+	Fingerprint zham.FingerprintProfile
+	Match       zham.MatchConfig
+	Live        LiveConfig
+	Store       db.Config
+	Files       FilesConfig
+}
+
+type ServerConfig struct {
+	Port           int
+	MaxUploadBytes int64
+	// BatchRoot is the directory POST /zham/batch may read from. Empty, the
+	// default, turns server side paths off.
+	BatchRoot string
+	// Debug allows POST /zham?debug=1, which answers with the peaks and
+	// offset histograms of the query, and mounts the /debug/spectrogram
+	// plots. Leave it off in production.
+	Debug bool
+}
+
+// LiveConfig bounds the WebSocket query sessions of /zham/live.
+type LiveConfig struct {
+	// IntervalMs is how much new audio is gathered between match attempts.
+	IntervalMs int
+	// MaxDurationSec ends a session that hasn't matched after this much
+	// audio, and IdleTimeoutSec one whose client stopped sending.
+	MaxDurationSec int
+	IdleTimeoutSec int
+	// MaxMessageBytes caps a single PCM message.
+	MaxMessageBytes int
+}
+
+type FilesConfig struct {
+	// Songs is the song catalogue, Zhams the per-song match counters.
+	Songs string
+	Zhams string
+}
+
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:           3030,
+			MaxUploadBytes: 10 << 20,
+		},
+		Fingerprint: unsetProfile(),
+		Match:       zham.DefaultMatchConfig(),
+		Live: LiveConfig{
+			IntervalMs:      1000,
+			MaxDurationSec:  30,
+			IdleTimeoutSec:  10,
+			MaxMessageBytes: 1 << 20,
+		},
+		Store: db.Config{
+			Backend:       db.BackendDisk,
+			MaxShardBytes: db.DefaultMaxShardBytes,
+		},
+		Files: FilesConfig{
+			Songs: "songs.json",
+			Zhams: "zham.json",
+		},
+	}
+}
+
+// unsetProfile is DefaultProfile with the settings that follow the store
+// left unset, see zham.CheckProfile.
+func unsetProfile() zham.FingerprintProfile {
+	p := zham.DefaultProfile()
+	p.Version = 0
+	p.Resampler = ""
+	return p
+}
+
+// Validate reports every setting that is out of range.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+		}
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server.port", "%d is not a TCP port", c.Server.Port)
+	check(c.Server.MaxUploadBytes > 0, "server.maxUploadBytes", "must be positive")
+	if err := c.Fingerprint.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("fingerprint: %w", err))
+	}
+	check(c.Match.WindowMs > 0, "match.windowMs", "must be positive")
+	check(c.Match.ZThreshold > 0, "match.zThreshold", "must be positive")
+	check(c.Match.MaxCandidates > 0, "match.maxCandidates", "must be positive")
+	check(c.Live.IntervalMs > 0, "live.intervalMs", "must be positive")
+	check(c.Live.MaxDurationSec > 0, "live.maxDurationSec", "must be positive")
+	check(c.Live.IdleTimeoutSec > 0, "live.idleTimeoutSec", "must be positive")
+	check(c.Live.MaxMessageBytes > 0, "live.maxMessageBytes", "must be positive")
+	check(c.Store.Backend == db.BackendDisk || c.Store.Backend == db.BackendJSON, "store.backend", "%q is neither %q nor %q", c.Store.Backend, db.BackendDisk, db.BackendJSON)
+	check(c.Store.MaxShardBytes > 0, "store.maxShardBytes", "must be positive")
+	check(c.Files.Songs != "", "files.songs", "must not be empty")
+	check(c.Files.Zhams != "", "files.zhams", "must not be empty")
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDefaultIsValid(t *testing.T) {
+	if err := Default().Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestValidateMessages(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Config)
+		want   string
+	}{
+		{"port", func(c *Config) { c.Server.Port = 70000 }, "server.port: 70000 is not a TCP port"},
+		{"upload size", func(c *Config) { c.Server.MaxUploadBytes = 0 }, "server.maxUploadBytes: must be positive"},
+		{"fingerprint", func(c *Config) { c.Fingerprint.Resampler = "linear" }, `fingerprint: Resampler: "linear" is not "sinc" or "ffmpeg"`},
+		{"window", func(c *Config) { c.Match.WindowMs = -1 }, "match.windowMs: must be positive"},
+		{"live interval", func(c *Config) { c.Live.IntervalMs = 0 }, "live.intervalMs: must be positive"},
+		{"backend", func(c *Config) { c.Store.Backend = "s3" }, `store.backend: "s3" is neither "disk" nor "json"`},
+		{"songs file", func(c *Config) { c.Files.Songs = "" }, "files.songs: must not be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEverySetting(t *testing.T) {
+	cfg := Default()
+	cfg.Server.Port = 0
+	cfg.Match.ZThreshold = 0
+	cfg.Files.Zhams = ""
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("no error")
+	}
+	lines := strings.Split(err.Error(), "\n")
+	want := []string{"server.port: 0 is not a TCP port", "match.zThreshold: must be positive", "files.zhams: must not be empty"}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("errors = %q, want %q", lines, want)
+	}
+}
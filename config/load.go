@@ -0,0 +1,330 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// setting binds one config field to its key. The key, e.g. "match.zThreshold",
+// names it in config files, the flag is its kebab-cased form
+// (-match.z-threshold) and the environment variable its upper snake-cased
+// form (ZHAM_MATCH_Z_THRESHOLD).
+type setting struct {
+	key   string
+	usage string
+	ptr   any
+}
+
+func (c *Config) settings() []setting {
+	return []setting{
+		{key: "server.port", usage: "HTTP port", ptr: &c.Server.Port},
+		{key: "server.maxUploadBytes", usage: "largest accepted upload", ptr: &c.Server.MaxUploadBytes},
+		{key: "server.batchRoot", usage: "directory POST /zham/batch may read from, empty disables it", ptr: &c.Server.BatchRoot},
+		{key: "server.debug", usage: "allow POST /zham?debug=1 to return the query's peaks and offset histograms and serve /debug/spectrogram", ptr: &c.Server.Debug},
+		{key: "fingerprint.version", usage: "fingerprinting code version, 0 follows the store or takes the latest for a new one", ptr: &c.Fingerprint.Version},
+		{key: "fingerprint.sampleRate", usage: "rate audio is resampled to before fingerprinting", ptr: &c.Fingerprint.SampleRate},
+		{key: "fingerprint.cutoffHz", usage: "low-pass cutoff before downsampling", ptr: &c.Fingerprint.CutoffHz},
+		{key: "fingerprint.dspRatio", usage: "downsampling factor", ptr: &c.Fingerprint.DSPRatio},
+		{key: "fingerprint.resampler", usage: "sinc or ffmpeg, empty follows the store or takes sinc for a new one", ptr: &c.Fingerprint.Resampler},
+		{key: "fingerprint.freqBinSize", usage: "FFT size", ptr: &c.Fingerprint.FreqBinSize},
+		{key: "fingerprint.hopSize", usage: "step between FFT windows", ptr: &c.Fingerprint.HopSize},
+		{key: "fingerprint.minBandHz", usage: "lowest peak band edge", ptr: &c.Fingerprint.MinBandHz},
+		{key: "fingerprint.maxBandHz", usage: "highest peak band edge", ptr: &c.Fingerprint.MaxBandHz},
+		{key: "fingerprint.numBands", usage: "number of log-spaced band edges", ptr: &c.Fingerprint.NumBands},
+		{key: "fingerprint.peakDistTime", usage: "peak neighbourhood in frames", ptr: &c.Fingerprint.PeakDistTime},
+		{key: "fingerprint.peakDistFreq", usage: "peak neighbourhood in bands", ptr: &c.Fingerprint.PeakDistFreq},
+		{key: "fingerprint.targetZoneSize", usage: "peaks paired with each anchor", ptr: &c.Fingerprint.TargetZoneSize},
+		{key: "fingerprint.maxDeltaMs", usage: "furthest target from its anchor", ptr: &c.Fingerprint.MaxDeltaMs},
+		{key: "match.windowMs", usage: "offset histogram window in ms", ptr: &c.Match.WindowMs},
+		{key: "match.zThreshold", usage: "z-score a match needs to be confident", ptr: &c.Match.ZThreshold},
+		{key: "match.maxCandidates", usage: "candidates returned per query", ptr: &c.Match.MaxCandidates},
+		{key: "live.intervalMs", usage: "audio gathered between live match attempts, in ms", ptr: &c.Live.IntervalMs},
+		{key: "live.maxDurationSec", usage: "longest live query session", ptr: &c.Live.MaxDurationSec},
+		{key: "live.idleTimeoutSec", usage: "how long a live client may stay silent", ptr: &c.Live.IdleTimeoutSec},
+		{key: "live.maxMessageBytes", usage: "largest live PCM message", ptr: &c.Live.MaxMessageBytes},
+		{key: "store.backend", usage: "store backend, disk or json", ptr: &c.Store.Backend},
+		{key: "store.path", usage: "store directory (default zhamdb for disk, . for json)", ptr: &c.Store.Path},
+		{key: "store.maxShardBytes", usage: "largest JSON shard", ptr: &c.Store.MaxShardBytes},
+		{key: "files.songs", usage: "song catalogue file", ptr: &c.Files.Songs},
+		{key: "files.zhams", usage: "zham counter file", ptr: &c.Files.Zhams},
+	}
+}
+
+func (s setting) flagName() string {
+	var b strings.Builder
+	for _, r := range s.key {
+		if unicode.IsUpper(r) {
+			b.WriteByte('-')
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s setting) envName() string {
+	return "ZHAM_" + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(s.flagName()))
+}
+
+func (s setting) set(value string) error {
+	value = strings.TrimSpace(value)
+
+	var err error
+	switch p := s.ptr.(type) {
+	case *string:
+		*p = value
+	case *bool:
+		*p, err = strconv.ParseBool(value)
+	case *int:
+		*p, err = strconv.Atoi(value)
+	case *int64:
+		*p, err = strconv.ParseInt(value, 10, 64)
+	case *float64:
+		*p, err = strconv.ParseFloat(value, 64)
+	default:
+		panic(fmt.Sprintf("config: unsupported setting type %T", s.ptr))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q", s.key, value)
+	}
+	return nil
+}
+
+func (s setting) String() string {
+	switch p := s.ptr.(type) {
+	case *string:
+		return *p
+	case *bool:
+		return strconv.FormatBool(*p)
+	case *int:
+		return strconv.Itoa(*p)
+	case *int64:
+		return strconv.FormatInt(*p, 10)
+	case *float64:
+		return strconv.FormatFloat(*p, 'g', -1, 64)
+	}
+	return ""
+}
+
+// normalizeKey makes keys match regardless of case, '_' and '-', so
+// "maxUploadBytes", "max_upload_bytes" and "MaxUploadBytes" are the same.
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "", "-", "").Replace(key))
+}
+
+// Loader registers the config flags on a FlagSet and builds the Config once
+// the flags are parsed.
+type Loader struct {
+	path  string
+	flags map[string]string
+}
+
+// flagValue records the flags given on the command line so they can be
+// applied after the file and the environment.
+type flagValue struct {
+	loader *Loader
+	key    string
+	def    string
+	isBool bool
+}
+
+func (f *flagValue) String() string { return f.def }
+
+// IsBoolFlag lets boolean settings be given as a bare flag, e.g. -server.debug.
+func (f *flagValue) IsBoolFlag() bool { return f.isBool }
+
+func (f *flagValue) Set(value string) error {
+	f.loader.flags[f.key] = value
+	return nil
+}
+
+// NewLoader adds -config and one flag per setting to fs.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	l := &Loader{flags: map[string]string{}}
+	fs.StringVar(&l.path, "config", os.Getenv("ZHAM_CONFIG"), "JSON or YAML config file")
+
+	for _, s := range Default().settings() {
+		_, isBool := s.ptr.(*bool)
+		fs.Var(&flagValue{loader: l, key: s.key, def: s.String(), isBool: isBool}, s.flagName(), s.usage)
+	}
+	return l
+}
+
+// Load returns the defaults overridden by the config file, the environment
+// and the parsed flags, in that order, and validates the result.
+func (l *Loader) Load() (*Config, error) {
+	cfg := Default()
+	settings := cfg.settings()
+
+	if l.path != "" {
+		values, err := readFile(l.path)
+		if err != nil {
+			return nil, err
+		}
+		byKey := map[string]setting{}
+		for _, s := range settings {
+			byKey[normalizeKey(s.key)] = s
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			s, ok := byKey[normalizeKey(key)]
+			if !ok {
+				return nil, fmt.Errorf("%s: unknown setting %q", l.path, key)
+			}
+			if err := s.set(values[key]); err != nil {
+				return nil, fmt.Errorf("%s: %v", l.path, err)
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if value, ok := os.LookupEnv(s.envName()); ok && value != "" {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("%s: %v", s.envName(), err)
+			}
+		}
+		if value, ok := l.flags[s.key]; ok {
+			if err := s.set(value); err != nil {
+				return nil, fmt.Errorf("-%s: %v", s.flagName(), err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readFile flattens a config file into "section.key" values. Files ending in
+// .json are JSON objects of objects, anything else is read as the YAML subset
+// of readYAML.
+func readFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		values, err := readJSON(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		return values, nil
+	}
+
+	values, err := readYAML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return values, nil
+}
+
+func readJSON(data []byte) (map[string]string, error) {
+	var sections map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	for section, fields := range sections {
+		for key, raw := range fields {
+			value := string(raw)
+			var str string
+			if json.Unmarshal(raw, &str) == nil {
+				value = str
+			}
+			values[section+"."+key] = value
+		}
+	}
+	return values, nil
+}
+
+// readYAML reads the subset of YAML a config needs: top-level section keys
+// each followed by "key: value" lines indented alike. Comments, blank lines
+// and quoted scalars are supported; deeper nesting, lists, anchors and flow
+// style aren't.
+func readYAML(data []byte) (map[string]string, error) {
+	values := map[string]string{}
+	section := ""
+	indent := "" // of the current section's keys, once its first is read
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := stripComment(scanner.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", lineNum)
+		}
+		key = strings.TrimSpace(key)
+		value = unquote(strings.TrimSpace(value))
+
+		lineIndent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		switch {
+		case lineIndent == "" && value == "":
+			section = key
+			indent = ""
+		case lineIndent == "" || section == "":
+			return nil, fmt.Errorf("line %d: %q is not inside a section", lineNum, key)
+		case indent != "" && lineIndent != indent:
+			return nil, fmt.Errorf("line %d: %q is indented unlike the rest of %s", lineNum, key, section)
+		default:
+			indent = lineIndent
+			values[section+"."+key] = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// stripComment drops a trailing # comment that isn't inside quotes.
+func stripComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func unquote(value string) string {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		if value[0] == '"' {
+			if s, err := strconv.Unquote(value); err == nil {
+				return s
+			}
+			return value[1 : len(value)-1]
+		}
+		// a single quoted scalar escapes a quote by doubling it
+		return strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+	}
+	return value
+}
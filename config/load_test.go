@@ -0,0 +1,183 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func load(t *testing.T, args ...string) (*Config, error) {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := NewLoader(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return loader.Load()
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "zham.yaml", `
+server:
+  port: 1000
+match:
+  windowMs: 10
+  zThreshold: 2.5
+live:
+  intervalMs: 700
+`)
+	t.Setenv("ZHAM_SERVER_PORT", "2000")
+	t.Setenv("ZHAM_MATCH_WINDOW_MS", "20")
+
+	cfg, err := load(t, "-config", path, "-server.port", "3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	def := Default()
+	tests := []struct {
+		key       string
+		got, want any
+	}{
+		{"server.port (flag)", cfg.Server.Port, 3000},
+		{"match.windowMs (env)", cfg.Match.WindowMs, 20},
+		{"match.zThreshold (file)", cfg.Match.ZThreshold, 2.5},
+		{"live.intervalMs (file)", cfg.Live.IntervalMs, 700},
+		{"match.maxCandidates (default)", cfg.Match.MaxCandidates, def.Match.MaxCandidates},
+		{"store.backend (default)", cfg.Store.Backend, def.Store.Backend},
+	}
+	for _, tt := range tests {
+		if fmt.Sprint(tt.got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s = %v, want %v", tt.key, tt.got, tt.want)
+		}
+	}
+}
+
+func TestLoadJSONFile(t *testing.T) {
+	path := writeConfig(t, "zham.json", `{"server": {"port": 4000, "batchRoot": "/srv/audio"}, "store": {"backend": "json"}}`)
+
+	cfg, err := load(t, "-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 4000 || cfg.Server.BatchRoot != "/srv/audio" || cfg.Store.Backend != "json" {
+		t.Errorf("loaded %+v and %+v", cfg.Server, cfg.Store)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  string
+		args []string
+		want string
+	}{
+		{name: "unknown key", file: "server:\n  nope: 1\n", want: `unknown setting "server.nope"`},
+		{name: "bad file value", file: "server:\n  port: many\n", want: `server.port: invalid value "many"`},
+		{name: "bad env value", env: "x", want: `ZHAM_SERVER_PORT: server.port: invalid value "x"`},
+		{name: "bad flag value", args: []string{"-server.port", "x"}, want: `-server.port: server.port: invalid value "x"`},
+		{name: "invalid result", args: []string{"-server.port", "0"}, want: "server.port: 0 is not a TCP port"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, "zham.yaml", tt.file)}, args...)
+			}
+			if tt.env != "" {
+				t.Setenv("ZHAM_SERVER_PORT", tt.env)
+			}
+
+			_, err := load(t, args...)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want it to contain %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want map[string]string
+	}{
+		{
+			name: "sections",
+			yaml: "server:\n  port: 3030\n  debug: true\nstore:\n    path: /var/zham\n",
+			want: map[string]string{"server.port": "3030", "server.debug": "true", "store.path": "/var/zham"},
+		},
+		{
+			name: "tab indentation",
+			yaml: "server:\n\tport: 3030\n",
+			want: map[string]string{"server.port": "3030"},
+		},
+		{
+			name: "comments and blank lines",
+			yaml: "# zham\n\nserver: # the API\n  # the port\n  port: 3030 # default\n\n",
+			want: map[string]string{"server.port": "3030"},
+		},
+		{
+			name: "quoting",
+			yaml: "files:\n  songs: \"my songs#1.json\"\n  zhams: 'it''s # here'\nstore:\n  path: \"a\\tb\"\n  backend: \"\"\n",
+			want: map[string]string{"files.songs": "my songs#1.json", "files.zhams": "it's # here", "store.path": "a\tb", "store.backend": ""},
+		},
+		{
+			name: "hash inside a value",
+			yaml: "store:\n  path: dir#1\n",
+			want: map[string]string{"store.path": "dir#1"},
+		},
+		{
+			name: "colon inside a value",
+			yaml: "store:\n  path: \"c:/zham\"\n",
+			want: map[string]string{"store.path": "c:/zham"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readYAML([]byte(tt.yaml))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want string
+	}{
+		{"key before any section", "  port: 3030\n", `line 1: "port" is not inside a section`},
+		{"top-level value", "server:\n  port: 1\nport: 3030\n", `line 3: "port" is not inside a section`},
+		{"deeper nesting", "server:\n  port: 1\n    debug: true\n", `line 3: "debug" is indented unlike the rest of server`},
+		{"shallower key", "server:\n    port: 1\n  debug: true\n", `line 3: "debug" is indented unlike the rest of server`},
+		{"tabs and spaces", "server:\n  port: 1\n\tdebug: true\n", `line 3: "debug" is indented unlike the rest of server`},
+		{"no colon", "server:\n  port 3030\n", `line 2: expected "key: value"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readYAML([]byte(tt.yaml))
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"zham-app/models"
+)
+
+var errBadPostings = errors.New("malformed postings")
+
+// SongDict maps song IDs to dense uint32 ordinals so postings can refer to a
+// song with a varint instead of repeating its ID.
+type SongDict struct {
+	ids      []string
+	ordinals map[string]uint32
+}
+
+func NewSongDict() *SongDict {
+	return &SongDict{ordinals: map[string]uint32{}}
+}
+
+// Ordinal returns the ordinal of songID, adding it to the dictionary if needed.
+func (d *SongDict) Ordinal(songID string) uint32 {
+	if ord, ok := d.ordinals[songID]; ok {
+		return ord
+	}
+
+	ord := uint32(len(d.ids))
+	d.ids = append(d.ids, songID)
+	d.ordinals[songID] = ord
+	return ord
+}
+
+// Lookup returns the ordinal of songID without adding it.
+func (d *SongDict) Lookup(songID string) (uint32, bool) {
+	ord, ok := d.ordinals[songID]
+	return ord, ok
+}
+
+func (d *SongDict) SongID(ord uint32) (string, bool) {
+	if int(ord) >= len(d.ids) {
+		return "", false
+	}
+	return d.ids[ord], true
+}
+
+func (d *SongDict) Len() int {
+	return len(d.ids)
+}
+
+// MarshalBinary encodes the dictionary as a uvarint count followed by
+// uvarint length prefixed IDs, in ordinal order.
+func (d *SongDict) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(d.ids)))
+	for _, id := range d.ids {
+		buf = binary.AppendUvarint(buf, uint64(len(id)))
+		buf = append(buf, id...)
+	}
+	return buf, nil
+}
+
+func (d *SongDict) UnmarshalBinary(data []byte) error {
+	_, err := d.decode(data)
+	return err
+}
+
+// decode reads a dictionary written by MarshalBinary from the start of data
+// and returns the number of bytes it used.
+func (d *SongDict) decode(data []byte) (int, error) {
+	n, pos := binary.Uvarint(data)
+	if pos <= 0 || n > uint64(len(data)) {
+		return 0, fmt.Errorf("song dictionary: %w", errBadPostings)
+	}
+
+	d.ids = make([]string, 0, n)
+	d.ordinals = make(map[string]uint32, n)
+	for i := uint64(0); i < n; i++ {
+		l, k := binary.Uvarint(data[pos:])
+		if k <= 0 || l > uint64(len(data)-pos-k) {
+			return 0, fmt.Errorf("song dictionary: %w", errBadPostings)
+		}
+		pos += k
+		d.Ordinal(string(data[pos : pos+int(l)]))
+		pos += int(l)
+	}
+
+	return pos, nil
+}
+
+// EncodePostings appends the couples of one address to dst. Couples are sorted
+// by song ordinal and anchor time, then written as
+//
+//	uvarint count
+//	per couple: uvarint song delta, uvarint anchor
+//
+// where the song delta is relative to the previous couple and the anchor is
+// relative to the previous anchor when the song is unchanged (absolute
+// otherwise). Song IDs not yet in dict are added to it.
+func EncodePostings(dst []byte, couples []models.Couple, dict *SongDict) []byte {
+	compact := make([]compactCouple, len(couples))
+	for i, c := range couples {
+		compact[i] = compactCouple{song: dict.Ordinal(c.SongID), anchor: c.AnchorTimeMs}
+	}
+	return encodeCompact(dst, compact)
+}
+
+func encodeCompact(dst []byte, compact []compactCouple) []byte {
+	sort.Slice(compact, func(i, j int) bool {
+		if compact[i].song != compact[j].song {
+			return compact[i].song < compact[j].song
+		}
+		return compact[i].anchor < compact[j].anchor
+	})
+
+	dst = binary.AppendUvarint(dst, uint64(len(compact)))
+
+	var prevSong, prevAnchor uint32
+	for _, c := range compact {
+		songDelta := c.song - prevSong
+		dst = binary.AppendUvarint(dst, uint64(songDelta))
+		if songDelta == 0 {
+			dst = binary.AppendUvarint(dst, uint64(c.anchor-prevAnchor))
+		} else {
+			dst = binary.AppendUvarint(dst, uint64(c.anchor))
+		}
+		prevSong, prevAnchor = c.song, c.anchor
+	}
+
+	return dst
+}
+
+// DecodePostings reads one block written by EncodePostings from the start of
+// src. It returns the couples and the number of bytes consumed.
+func DecodePostings(src []byte, dict *SongDict) ([]models.Couple, int, error) {
+	compact, n, err := decodeCompact(src)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	couples := make([]models.Couple, len(compact))
+	for i, c := range compact {
+		songID, ok := dict.SongID(c.song)
+		if !ok {
+			return nil, 0, fmt.Errorf("song ordinal %d: %w", c.song, errBadPostings)
+		}
+		couples[i] = models.Couple{SongID: songID, AnchorTimeMs: c.anchor}
+	}
+
+	return couples, n, nil
+}
+
+func decodeCompact(src []byte) ([]compactCouple, int, error) {
+	count, pos := binary.Uvarint(src)
+	// every couple takes at least two bytes
+	if pos <= 0 || count > uint64(len(src)-pos)/2 {
+		return nil, 0, errBadPostings
+	}
+
+	compact := make([]compactCouple, count)
+	var prevSong, prevAnchor uint64
+	for i := range compact {
+		songDelta, k := binary.Uvarint(src[pos:])
+		if k <= 0 {
+			return nil, 0, errBadPostings
+		}
+		pos += k
+
+		anchor, k := binary.Uvarint(src[pos:])
+		if k <= 0 {
+			return nil, 0, errBadPostings
+		}
+		pos += k
+
+		song := prevSong + songDelta
+		if songDelta == 0 {
+			anchor += prevAnchor
+		}
+		if song > 0xFFFFFFFF || anchor > 0xFFFFFFFF {
+			return nil, 0, errBadPostings
+		}
+
+		compact[i] = compactCouple{song: uint32(song), anchor: uint32(anchor)}
+		prevSong, prevAnchor = song, anchor
+	}
+
+	return compact, pos, nil
+}
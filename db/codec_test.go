@@ -0,0 +1,169 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+
+	"zham-app/models"
+)
+
+func TestPostingsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		couples []models.Couple
+	}{
+		{"empty", []models.Couple{}},
+		{"single", []models.Couple{{AnchorTimeMs: 1234, SongID: "a"}}},
+		{"max anchor", []models.Couple{{AnchorTimeMs: math.MaxUint32, SongID: "a"}, {AnchorTimeMs: 0, SongID: "a"}}},
+		{"unsorted", []models.Couple{
+			{AnchorTimeMs: 900, SongID: "c"},
+			{AnchorTimeMs: 5, SongID: "a"},
+			{AnchorTimeMs: 300, SongID: "b"},
+			{AnchorTimeMs: 1, SongID: "a"},
+			{AnchorTimeMs: 300, SongID: "c"},
+		}},
+		{"duplicates", []models.Couple{{AnchorTimeMs: 7, SongID: "a"}, {AnchorTimeMs: 7, SongID: "a"}}},
+		{"odd ids", []models.Couple{{AnchorTimeMs: 1, SongID: "a#b"}, {AnchorTimeMs: 2, SongID: ""}, {AnchorTimeMs: 3, SongID: "ünï"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := make([]models.Couple, len(tt.couples))
+			copy(input, tt.couples)
+
+			dict := NewSongDict()
+			// a prefix and a suffix check that only the block is consumed
+			encoded := EncodePostings([]byte{0xAA}, tt.couples, dict)
+			encoded = append(encoded, 0xBB)
+
+			if !reflect.DeepEqual(input, tt.couples) {
+				t.Fatalf("EncodePostings modified its input: %v", tt.couples)
+			}
+
+			// through the binary form of the dictionary, as segments store it
+			dictData, err := dict.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decodedDict SongDict
+			if err := decodedDict.UnmarshalBinary(dictData); err != nil {
+				t.Fatal(err)
+			}
+
+			got, n, err := DecodePostings(encoded[1:], &decodedDict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(encoded)-2 {
+				t.Errorf("consumed %d bytes, want %d", n, len(encoded)-2)
+			}
+
+			// decoded postings come sorted by song ordinal, then anchor
+			want := append([]models.Couple{}, tt.couples...)
+			sort.SliceStable(want, func(i, j int) bool {
+				oi, _ := dict.Lookup(want[i].SongID)
+				oj, _ := dict.Lookup(want[j].SongID)
+				if oi != oj {
+					return oi < oj
+				}
+				return want[i].AnchorTimeMs < want[j].AnchorTimeMs
+			})
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestCompactMaxWidths covers ordinals and anchors needing the widest varints,
+// which no dictionary in a test can reach.
+func TestCompactMaxWidths(t *testing.T) {
+	compact := []compactCouple{
+		{song: math.MaxUint32, anchor: math.MaxUint32},
+		{song: 0, anchor: math.MaxUint32},
+		{song: math.MaxUint32, anchor: 0},
+		{song: 0, anchor: 0},
+		{song: 1 << 28, anchor: 1 << 21},
+	}
+	want := append([]compactCouple(nil), compact...)
+	sort.Slice(want, func(i, j int) bool {
+		if want[i].song != want[j].song {
+			return want[i].song < want[j].song
+		}
+		return want[i].anchor < want[j].anchor
+	})
+
+	encoded := encodeCompact(nil, compact)
+	got, n, err := decodeCompact(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(encoded) {
+		t.Errorf("consumed %d bytes of %d", n, len(encoded))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDecodePostingsMalformed(t *testing.T) {
+	dict := NewSongDict()
+	valid := EncodePostings(nil, []models.Couple{{AnchorTimeMs: 300, SongID: "a"}, {AnchorTimeMs: 70000, SongID: "b"}}, dict)
+
+	tests := []struct {
+		name string
+		data []byte
+		dict *SongDict
+	}{
+		{"empty", nil, dict},
+		{"truncated", valid[:len(valid)-1], dict},
+		{"count too large", binary.AppendUvarint(nil, 1000), dict},
+		{"unknown ordinal", valid, NewSongDict()},
+		{"anchor overflow", binary.AppendUvarint([]byte{1, 0}, math.MaxUint32+1), dict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := DecodePostings(tt.data, tt.dict); !errors.Is(err, errBadPostings) {
+				t.Errorf("err = %v, want errBadPostings", err)
+			}
+		})
+	}
+}
+
+func TestSongDictRoundTrip(t *testing.T) {
+	for _, ids := range [][]string{nil, {"a"}, {"song1", "", "a#b", string(make([]byte, 300))}} {
+		dict := NewSongDict()
+		for _, id := range ids {
+			dict.Ordinal(id)
+		}
+
+		data, err := dict.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded SongDict
+		if err := decoded.UnmarshalBinary(data); err != nil {
+			t.Fatalf("%q: %v", ids, err)
+		}
+
+		if decoded.Len() != len(ids) {
+			t.Errorf("%q: decoded %d IDs", ids, decoded.Len())
+		}
+		for i, id := range ids {
+			if got, ok := decoded.SongID(uint32(i)); !ok || got != id {
+				t.Errorf("%q: ordinal %d is %q, want %q", ids, i, got, id)
+			}
+			if ord, ok := decoded.Lookup(id); !ok || ord != uint32(i) {
+				t.Errorf("%q: %q has ordinal %d", ids, id, ord)
+			}
+		}
+		if err := decoded.UnmarshalBinary(data[:len(data)-1]); len(ids) > 0 && err == nil {
+			t.Errorf("%q: truncated dictionary decoded", ids)
+		}
+	}
+}
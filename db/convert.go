@@ -0,0 +1,26 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"zham-app/models"
+)
+
+var errBadCouple = errors.New("malformed couple")
+
+// ParseCouple decodes a "songId#anchorMs" entry of a JSON shard.
+func ParseCouple(entry string) (models.Couple, error) {
+	i := strings.LastIndexByte(entry, '#')
+	if i <= 0 {
+		return models.Couple{}, fmt.Errorf("%w %q", errBadCouple, entry)
+	}
+
+	anchor, err := strconv.ParseUint(entry[i+1:], 10, 32)
+	if err != nil {
+		return models.Couple{}, fmt.Errorf("%w %q", errBadCouple, entry)
+	}
+
+	return models.Couple{SongID: entry[:i], AnchorTimeMs: uint32(anchor)}, nil
+}
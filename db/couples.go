@@ -1,8 +1,8 @@
 package db
 
 import (
-	"strconv"
-	"strings"
+	"os"
+	"path/filepath"
 	"zham-app/models"
 )
 
@@ -11,27 +11,92 @@ type Res struct {
 	Couples []models.Couple
 }
 
-func GetCouples(addresses []uint32) ([]Res, error) {
-	database, err := ReadFromJSON("db.json")
+// JSONStore is the original Store backed by the db*.json shards, where every
+// couple is kept as a "songId#anchorMs" string.
+type JSONStore struct {
+	shards *ShardManager
+}
+
+// OpenJSONStore returns the JSON store whose shards live in dir.
+func OpenJSONStore(dir string, maxShardBytes int64) (_ *JSONStore, err error) {
+	defer wrapStorageErr("open", &err)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JSONStore{shards: NewShardManager(dir, maxShardBytes)}, nil
+}
+
+func (s *JSONStore) Put(fingerprints map[uint32][]models.Couple) (err error) {
+	defer wrapStorageErr("put", &err)
+
+	return s.shards.Write(fingerprints)
+}
+
+func (s *JSONStore) Lookup(addresses []uint32) (_ []Res, err error) {
+	defer wrapStorageErr("lookup", &err)
+
+	database, err := s.shards.ReadAll()
 	if err != nil {
 		return nil, err
 	}
 
 	res := []Res{}
 	for _, address := range addresses {
+		// res = append(res, Res{Address: address, Couples: database[address]})
+		res = append(res, Res{Address: address, Couples: parseCouples(database[address])})
+	}
 
-		couples := database[address]
-		couplesJson := make([]models.Couple, len(couples))
-		for i, c := range couples {
-			cSplit := strings.Split(c, "#")
-			num, _ := strconv.ParseUint(cSplit[1], 10, 32)
-			anchorTimeMs := uint32(num)
-			couplesJson[i] = models.Couple{SongID: cSplit[0], AnchorTimeMs: anchorTimeMs}
+	return res, nil
+}
+
+func (s *JSONStore) Scan(fn func(address uint32, couples []models.Couple) error) (err error) {
+	defer wrapStorageErr("scan", &err)
+
+	database, err := s.shards.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	for address, couples := range database {
+		if err := fn(address, parseCouples(couples)); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		// res = append(res, Res{Address: address, Couples: database[address]})
-		res = append(res, Res{Address: address, Couples: couplesJson})
+// parseCouples decodes "songId#anchorMs" strings, skipping malformed entries.
+func parseCouples(couples []string) []models.Couple {
+	couplesJson := make([]models.Couple, 0, len(couples))
+	for _, c := range couples {
+		couple, err := ParseCouple(c)
+		if err != nil {
+			continue
+		}
+		couplesJson = append(couplesJson, couple)
 	}
+	return couplesJson
+}
 
-	return res, nil
+func (s *JSONStore) DeleteSong(songID string) (err error) {
+	defer wrapStorageErr("delete", &err)
+
+	return s.shards.DeleteSong(songID)
+}
+
+func (s *JSONStore) Profile() (_ []byte, err error) {
+	defer wrapStorageErr("read profile", &err)
+
+	return readProfile(filepath.Join(s.shards.dir, "profile.json"))
+}
+
+func (s *JSONStore) SetProfile(profile []byte) (err error) {
+	defer wrapStorageErr("write profile", &err)
+
+	return writeFileAtomic(filepath.Join(s.shards.dir, "profile.json"), profile)
+}
+
+func (s *JSONStore) Close() error {
+	return nil
 }
@@ -0,0 +1,374 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"zham-app/models"
+)
+
+// maxSegments is how many segments DiskStore keeps before merging them into one.
+const maxSegments = 16
+
+// segmentManifest is the file listing the segments a DiskStore is made of.
+const segmentManifest = "MANIFEST"
+
+// DiskStore keeps couples in immutable, address sorted segment files inside a
+// directory. Every Put writes a new segment and only the segment indexes are
+// held in memory, so a Lookup reads just the postings of the queried
+// addresses. Only one process may have a directory open at a time.
+//
+// The MANIFEST file lists the live segments and is rewritten atomically
+// whenever they change, so a crash part way through a merge leaves either the
+// old segments or the merged one live, never both. Segment files it doesn't
+// list are removed on open; segments without a MANIFEST mean the directory is
+// corrupt, and it isn't opened.
+type DiskStore struct {
+	mu       sync.RWMutex
+	dir      string
+	lock     *os.File
+	segments []*segment
+	nextSeq  int
+}
+
+func OpenDiskStore(dir string) (_ *DiskStore, err error) {
+	defer wrapStorageErr("open", &err)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// segment names are picked from nextSeq, two processes writing the
+	// same directory would overwrite each other's segments
+	lock, err := os.OpenFile(filepath.Join(dir, "LOCK"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := tryLockExclusive(lock); err != nil {
+		lock.Close()
+		return nil, fmt.Errorf("%s: %w", dir, err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	s := &DiskStore{dir: dir, lock: lock, nextSeq: 1}
+
+	listed, err := s.readManifest()
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	var seqs []int
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".seg.tmp") {
+			// left over from an interrupted write
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".seg") {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimSuffix(name, ".seg"))
+		if err != nil {
+			continue
+		}
+		if listed == nil {
+			lock.Close()
+			return nil, fmt.Errorf("%s: segment %s but no %s", dir, name, segmentManifest)
+		}
+		if !listed[name] {
+			// written or superseded by a merge that didn't finish
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		delete(listed, name)
+		seqs = append(seqs, seq)
+	}
+	if len(listed) > 0 {
+		lock.Close()
+		return nil, fmt.Errorf("%s: %d segments in the manifest are missing", dir, len(listed))
+	}
+	sort.Ints(seqs)
+
+	for _, seq := range seqs {
+		seg, err := openSegment(s.segmentPath(seq))
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.segments = append(s.segments, seg)
+		s.nextSeq = seq + 1
+	}
+
+	if listed == nil {
+		// a new store
+		if err := s.writeManifest(nil); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// readManifest returns the names of the segments the manifest lists, or nil
+// when there is no manifest.
+func (s *DiskStore) readManifest() (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, segmentManifest))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	listed := map[string]bool{}
+	for _, name := range strings.Fields(string(data)) {
+		listed[name] = true
+	}
+	return listed, nil
+}
+
+// writeManifest makes segments the live ones. It is the commit point of every
+// change to the set of segments.
+func (s *DiskStore) writeManifest(segments []*segment) error {
+	var b strings.Builder
+	for _, seg := range segments {
+		b.WriteString(filepath.Base(seg.path))
+		b.WriteByte('\n')
+	}
+	return writeFileAtomic(filepath.Join(s.dir, segmentManifest), []byte(b.String()))
+}
+
+func (s *DiskStore) segmentPath(seq int) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%06d.seg", seq))
+}
+
+func (s *DiskStore) Put(fingerprints map[uint32][]models.Couple) (err error) {
+	defer wrapStorageErr("put", &err)
+
+	if len(fingerprints) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.addSegment(fingerprints); err != nil {
+		return err
+	}
+
+	if len(s.segments) > maxSegments {
+		return s.merge()
+	}
+	return nil
+}
+
+func (s *DiskStore) addSegment(fingerprints map[uint32][]models.Couple) error {
+	path := s.segmentPath(s.nextSeq)
+	if err := writeSegment(path, fingerprints); err != nil {
+		return err
+	}
+	s.nextSeq++
+
+	seg, err := openSegment(path)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+
+	segments := append(s.segments[:len(s.segments):len(s.segments)], seg)
+	if err := s.writeManifest(segments); err != nil {
+		seg.close()
+		os.Remove(path)
+		return err
+	}
+	s.segments = segments
+	return nil
+}
+
+// merge folds every segment into a single new one. The old segments are only
+// removed once the manifest lists the merged one instead.
+func (s *DiskStore) merge() error {
+	all := map[uint32][]models.Couple{}
+	for _, seg := range s.segments {
+		couples, err := seg.readAll()
+		if err != nil {
+			return err
+		}
+		for address, c := range couples {
+			all[address] = append(all[address], c...)
+		}
+	}
+
+	old := s.segments
+	s.segments = nil
+	if err := s.addSegment(all); err != nil {
+		s.segments = old
+		return err
+	}
+
+	for _, seg := range old {
+		seg.close()
+		os.Remove(seg.path)
+	}
+	return nil
+}
+
+func (s *DiskStore) Lookup(addresses []uint32) (_ []Res, err error) {
+	defer wrapStorageErr("lookup", &err)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]Res, len(addresses))
+	for i, address := range addresses {
+		res[i].Address = address
+		for _, seg := range s.segments {
+			couples, err := seg.lookup(address)
+			if err != nil {
+				return nil, err
+			}
+			res[i].Couples = append(res[i].Couples, couples...)
+		}
+	}
+
+	return res, nil
+}
+
+func (s *DiskStore) Scan(fn func(address uint32, couples []models.Couple) error) (err error) {
+	defer wrapStorageErr("scan", &err)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, seg := range s.segments {
+		if err := seg.scan(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteSong rewrites every segment holding songID without its couples. A
+// segment's old file handle is only closed once its replacement is in place,
+// so a failure part way leaves the remaining segments untouched. Segments
+// left empty are dropped from the manifest before their files are removed.
+func (s *DiskStore) DeleteSong(songID string) (err error) {
+	defer wrapStorageErr("delete", &err)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kept := make([]*segment, 0, len(s.segments))
+	var emptied []*segment
+	for i, seg := range s.segments {
+		if !seg.hasSong(songID) {
+			kept = append(kept, seg)
+			continue
+		}
+
+		rewritten, err := s.rewriteWithout(seg, songID)
+		if err != nil {
+			s.segments = append(append(kept, emptied...), s.segments[i:]...)
+			return err
+		}
+
+		if rewritten != nil {
+			seg.close()
+			kept = append(kept, rewritten)
+		} else {
+			emptied = append(emptied, seg)
+		}
+	}
+	if len(emptied) == 0 {
+		s.segments = kept
+		return nil
+	}
+
+	if err := s.writeManifest(kept); err != nil {
+		s.segments = append(kept, emptied...)
+		return err
+	}
+	s.segments = kept
+	for _, seg := range emptied {
+		seg.close()
+		os.Remove(seg.path)
+	}
+	return nil
+}
+
+// rewriteWithout replaces seg's file with a copy lacking songID's couples. It
+// returns the reopened segment, or nil leaving seg as it is when nothing
+// would be left.
+func (s *DiskStore) rewriteWithout(seg *segment, songID string) (*segment, error) {
+	couples, err := seg.readAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for address, c := range couples {
+		filtered := c[:0]
+		for _, couple := range c {
+			if couple.SongID != songID {
+				filtered = append(filtered, couple)
+			}
+		}
+		if len(filtered) == 0 {
+			delete(couples, address)
+		} else {
+			couples[address] = filtered
+		}
+	}
+
+	if len(couples) == 0 {
+		return nil, nil
+	}
+
+	if err := writeSegment(seg.path, couples); err != nil {
+		return nil, err
+	}
+	return openSegment(seg.path)
+}
+
+func (s *DiskStore) Profile() (_ []byte, err error) {
+	defer wrapStorageErr("read profile", &err)
+
+	return readProfile(filepath.Join(s.dir, "PROFILE"))
+}
+
+func (s *DiskStore) SetProfile(profile []byte) (err error) {
+	defer wrapStorageErr("write profile", &err)
+
+	return writeFileAtomic(filepath.Join(s.dir, "PROFILE"), profile)
+}
+
+func (s *DiskStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, seg := range s.segments {
+		if err := seg.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.segments = nil
+
+	if s.lock != nil {
+		unlockExclusive(s.lock)
+		s.lock.Close()
+		s.lock = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,234 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"zham-app/models"
+)
+
+// songCouples is the fingerprints of a song with a couple at each of addresses.
+func songCouples(songID string, addresses ...uint32) map[uint32][]models.Couple {
+	fingerprints := map[uint32][]models.Couple{}
+	for i, address := range addresses {
+		fingerprints[address] = []models.Couple{{AnchorTimeMs: uint32(i), SongID: songID}}
+	}
+	return fingerprints
+}
+
+// countCouples opens the store in dir and counts the couples of every song.
+func countCouples(t *testing.T, dir string) map[string]int {
+	t.Helper()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	counts := map[string]int{}
+	err = s.Scan(func(address uint32, couples []models.Couple) error {
+		for _, c := range couples {
+			counts[c.SongID]++
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range names {
+		names[i] = filepath.Base(name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newThreeSegmentStore returns a closed store of three songs in a segment
+// each, and all of their couples.
+func newThreeSegmentStore(t *testing.T) (string, map[uint32][]models.Couple) {
+	dir := t.TempDir()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := map[uint32][]models.Couple{}
+	for i := 0; i < 3; i++ {
+		fingerprints := songCouples(fmt.Sprint("song", i), 1, 2, uint32(10+i))
+		if err := s.Put(fingerprints); err != nil {
+			t.Fatal(err)
+		}
+		for address, couples := range fingerprints {
+			all[address] = append(all[address], couples...)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return dir, all
+}
+
+var threeSongs = map[string]int{"song0": 3, "song1": 3, "song2": 3}
+
+func TestDiskStoreDropsUnlistedMergedSegment(t *testing.T) {
+	dir, all := newThreeSegmentStore(t)
+
+	// a merge that crashed after writing its segment, before the manifest
+	if err := writeSegment(filepath.Join(dir, "000004.seg"), all); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts := countCouples(t, dir); fmt.Sprint(counts) != fmt.Sprint(threeSongs) {
+		t.Errorf("couples per song = %v, want %v", counts, threeSongs)
+	}
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("segments after reopening = %v, want the three listed ones", files)
+	}
+}
+
+func TestDiskStoreDropsSupersededSegments(t *testing.T) {
+	dir, all := newThreeSegmentStore(t)
+
+	// a merge that crashed after the manifest, before removing the old
+	// segments
+	if err := writeSegment(filepath.Join(dir, "000004.seg"), all); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFileAtomic(filepath.Join(dir, segmentManifest), []byte("000004.seg\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	if counts := countCouples(t, dir); fmt.Sprint(counts) != fmt.Sprint(threeSongs) {
+		t.Errorf("couples per song = %v, want %v", counts, threeSongs)
+	}
+	if files := segmentFiles(t, dir); fmt.Sprint(files) != "[000004.seg]" {
+		t.Errorf("segments after reopening = %v, want only the merged one", files)
+	}
+}
+
+func TestDiskStoreWithoutManifest(t *testing.T) {
+	dir, _ := newThreeSegmentStore(t)
+	if err := os.Remove(filepath.Join(dir, segmentManifest)); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := OpenDiskStore(dir); err == nil {
+		s.Close()
+		t.Error("opened a store holding segments but no manifest")
+	}
+	if files := segmentFiles(t, dir); len(files) != 3 {
+		t.Errorf("segments after the failed open = %v, want all three kept", files)
+	}
+}
+
+func TestDiskStoreNewWritesManifest(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, segmentManifest))
+	if err != nil || len(data) != 0 {
+		t.Errorf("manifest of a new store = %q, %v, want it empty", data, err)
+	}
+}
+
+func TestDiskStoreMissingListedSegment(t *testing.T) {
+	dir, _ := newThreeSegmentStore(t)
+	if err := os.Remove(filepath.Join(dir, "000002.seg")); err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := OpenDiskStore(dir); err == nil {
+		s.Close()
+		t.Error("opened a store missing a listed segment")
+	}
+}
+
+func TestDiskStoreMerge(t *testing.T) {
+	dir := t.TempDir()
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i <= maxSegments; i++ {
+		if err := s.Put(songCouples(fmt.Sprint("song", i), 1, uint32(100+i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := segmentFiles(t, dir); len(files) != 1 {
+		t.Errorf("segments after merging = %v, want one", files)
+	}
+	counts := countCouples(t, dir)
+	if len(counts) != maxSegments+1 {
+		t.Errorf("%d songs after merging, want %d", len(counts), maxSegments+1)
+	}
+	for id, n := range counts {
+		if n != 2 {
+			t.Errorf("%s has %d couples, want 2", id, n)
+		}
+	}
+}
+
+func TestDiskStoreDeleteEmptiesSegment(t *testing.T) {
+	dir, _ := newThreeSegmentStore(t)
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteSong("song1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if files := segmentFiles(t, dir); fmt.Sprint(files) != "[000001.seg 000003.seg]" {
+		t.Errorf("segments after the delete = %v", files)
+	}
+	want := map[string]int{"song0": 3, "song2": 3}
+	if counts := countCouples(t, dir); fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("couples per song = %v, want %v", counts, want)
+	}
+}
+
+func TestOpenSegmentRejectsOtherVersions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "000001.seg")
+	if err := writeSegment(path, songCouples("song0", 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []byte{1, 3} {
+		data[4] = version
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if seg, err := openSegment(path); err == nil {
+			seg.close()
+			t.Errorf("opened a version %d segment", version)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"sync"
+	"unsafe"
+	"zham-app/models"
+)
+
+// compactCouple is a couple with its song ID replaced by a SongDict ordinal,
+// 8 bytes instead of a string header per posting.
+type compactCouple struct {
+	song   uint32
+	anchor uint32
+}
+
+// Index is an in-memory inverted index loaded from a Store once and kept in
+// step with it. It implements Store itself: lookups are served from memory
+// while Put and DeleteSong write through to the underlying store first.
+type Index struct {
+	// writeMu keeps store and memory updates in the same order, mu guards
+	// the in-memory state so lookups only wait for the memory update
+	writeMu sync.Mutex
+	mu      sync.RWMutex
+	store   Store
+
+	postings    map[uint32][]compactCouple
+	dict        *SongDict
+	songCouples []int // couples per ordinal, zero once a song is deleted
+	numCouples  int
+}
+
+// IndexStats describes the size of an Index. Bytes is an estimate of the
+// memory held by the postings, the map and the song table.
+type IndexStats struct {
+	Addresses int
+	Couples   int
+	Songs     int
+	Bytes     int
+}
+
+// NewIndex scans every couple of store into memory.
+func NewIndex(store Store) (*Index, error) {
+	ix := &Index{
+		store:    store,
+		postings: map[uint32][]compactCouple{},
+		dict:     NewSongDict(),
+	}
+
+	err := store.Scan(func(address uint32, couples []models.Couple) error {
+		ix.add(address, couples)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ix, nil
+}
+
+func (ix *Index) ordinal(songID string) uint32 {
+	ord := ix.dict.Ordinal(songID)
+	for int(ord) >= len(ix.songCouples) {
+		ix.songCouples = append(ix.songCouples, 0)
+	}
+	return ord
+}
+
+func (ix *Index) add(address uint32, couples []models.Couple) {
+	for _, c := range couples {
+		ord := ix.ordinal(c.SongID)
+		ix.postings[address] = append(ix.postings[address], compactCouple{song: ord, anchor: c.AnchorTimeMs})
+		ix.songCouples[ord]++
+	}
+	ix.numCouples += len(couples)
+}
+
+func (ix *Index) Put(fingerprints map[uint32][]models.Couple) error {
+	ix.writeMu.Lock()
+	defer ix.writeMu.Unlock()
+
+	if err := ix.store.Put(fingerprints); err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	for address, couples := range fingerprints {
+		ix.add(address, couples)
+	}
+	return nil
+}
+
+func (ix *Index) Lookup(addresses []uint32) ([]Res, error) {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	res := make([]Res, len(addresses))
+	for i, address := range addresses {
+		postings := ix.postings[address]
+		couples := make([]models.Couple, len(postings))
+		for j, p := range postings {
+			couples[j] = models.Couple{SongID: ix.dict.ids[p.song], AnchorTimeMs: p.anchor}
+		}
+		res[i] = Res{Address: address, Couples: couples}
+	}
+
+	return res, nil
+}
+
+// DeleteSong removes the song from the store and then from memory. The song
+// keeps its ordinal so a re-ingest reuses it.
+func (ix *Index) DeleteSong(songID string) error {
+	ix.writeMu.Lock()
+	defer ix.writeMu.Unlock()
+
+	if err := ix.store.DeleteSong(songID); err != nil {
+		return err
+	}
+
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+
+	ord, ok := ix.dict.Lookup(songID)
+	if !ok {
+		return nil
+	}
+
+	for address, postings := range ix.postings {
+		kept := postings[:0]
+		for _, p := range postings {
+			if p.song != ord {
+				kept = append(kept, p)
+			}
+		}
+		ix.numCouples -= len(postings) - len(kept)
+		ix.songCouples[ord] -= len(postings) - len(kept)
+		if len(kept) == 0 {
+			delete(ix.postings, address)
+		} else {
+			ix.postings[address] = kept
+		}
+	}
+	return nil
+}
+
+func (ix *Index) Scan(fn func(address uint32, couples []models.Couple) error) error {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	for address, postings := range ix.postings {
+		couples := make([]models.Couple, len(postings))
+		for j, p := range postings {
+			couples[j] = models.Couple{SongID: ix.dict.ids[p.song], AnchorTimeMs: p.anchor}
+		}
+		if err := fn(address, couples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ix *Index) Profile() ([]byte, error) {
+	return ix.store.Profile()
+}
+
+func (ix *Index) SetProfile(profile []byte) error {
+	return ix.store.SetProfile(profile)
+}
+
+func (ix *Index) Close() error {
+	return ix.store.Close()
+}
+
+func (ix *Index) Stats() IndexStats {
+	ix.mu.RLock()
+	defer ix.mu.RUnlock()
+
+	const (
+		coupleSize = int(unsafe.Sizeof(compactCouple{}))
+		// key, slice header and roughly one word of bucket overhead per entry
+		mapEntrySize = 4 + int(unsafe.Sizeof([]compactCouple{})) + 8
+		stringSize   = int(unsafe.Sizeof(""))
+	)
+
+	bytes := len(ix.postings) * mapEntrySize
+	for _, postings := range ix.postings {
+		bytes += cap(postings) * coupleSize
+	}
+	songs := 0
+	for ord, id := range ix.dict.ids {
+		// the ID is held by both the song table and the ordinal map
+		bytes += 2*stringSize + len(id) + 4 + 8
+		if ix.songCouples[ord] > 0 {
+			songs++
+		}
+	}
+
+	return IndexStats{
+		Addresses: len(ix.postings),
+		Couples:   ix.numCouples,
+		Songs:     songs,
+		Bytes:     bytes,
+	}
+}
@@ -2,135 +2,106 @@ package db
 
 import (
 	"encoding/json"
-	"fmt"
 	"os"
-	"zham-app/models"
 )
 
-func findCleanPath() (string, error) {
-	filePaths := []string{"db10.json", "db9.json", "db8.json", "db7.json", "db6.json", "db5.json", "db4.json", "db3.json", "db2.json", "db.json"}
-	var resPath string
-
-	for _, path := range filePaths {
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return "", err
-		}
-
-		// var resTmp map[uint32][]models.Couple
-		var resTmp map[uint32][]string
-		if err := json.Unmarshal(data, &resTmp); err != nil {
-			return "", err
-		}
-
-		if len(resTmp) > 0 {
-			break
-		} else {
-			resPath = path
-		}
-	}
-	return resPath, nil
-}
-
-func ReadFromJSON(filePath string) (map[uint32][]string, error) {
-	filePaths := []string{"db.json", "db2.json", "db3.json", "db4.json", "db5.json", "db6.json", "db7.json", "db8.json", "db9.json", "db10.json"}
-	// res := make(map[uint32][]models.Couple)
-	res := make(map[uint32][]string)
+// ReadNumZham returns how many times songId was matched, or ErrNotFound if
+// it has no counter yet.
+func ReadNumZham(filePath string, songId string) (_ int, err error) {
+	defer wrapStorageErr("read zham count", &err)
 
-	for _, path := range filePaths {
-		data, err := os.ReadFile(path)
-		if err != nil {
-			return nil, err
-		}
-
-		// var resTmp map[uint32][]models.Couple
-		var resTmp map[uint32][]string
-		if err := json.Unmarshal(data, &resTmp); err != nil {
-			return nil, err
-		}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return 0, err
+	}
 
-		for address, couples := range resTmp {
-			if _, ok := res[address]; !ok {
-				// res[address] = make([]models.Couple, 0)
-				res[address] = make([]string, 0)
-			}
-			res[address] = append(res[address], couples...)
-		}
+	var db map[string]int
+	if err := json.Unmarshal(data, &db); err != nil {
+		return 0, err
+	}
+	if db == nil {
+		// the file holds null
+		db = map[string]int{}
 	}
 
-	return res, nil
+	cnt, ok := db[songId]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return cnt, nil
 }
 
-func WriteToJSON(filePath string, dataToStore map[uint32][]models.Couple) error {
-
-	// dbData := map[uint32][]models.Couple{}
-	dbData := map[uint32][]string{}
+func WriteToZhamJSON(filePath string, songId string) (_ int, err error) {
+	defer wrapStorageErr("write zham count", &err)
 
-	dbPath, err := findCleanPath()
+	unlock, err := lockFile(filePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
+	defer unlock()
 
-	for address, couples := range dataToStore {
-		if _, ok := dbData[address]; !ok {
-			// dbData[address] = make([]models.Couple, 0)
-			dbData[address] = make([]string, 0)
-		}
-
-		couplesString := make([]string, len(couples))
-		for i, c := range couples {
-			couplesString[i] = c.SongID + "#" + fmt.Sprint(c.AnchorTimeMs)
-		}
-
-		dbData[address] = append(dbData[address], couplesString...)
-
-		// dbData[address] = append(dbData[address], couples...)
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return 0, err
 	}
 
-	data, err := json.MarshalIndent(dbData, "", " ")
-	if err != nil {
-		return err
+	var db map[string]int
+	if err := json.Unmarshal(data, &db); err != nil {
+		return 0, err
+	}
+	if db == nil {
+		// the file holds null
+		db = map[string]int{}
 	}
 
-	return os.WriteFile(dbPath, data, 0644)
-}
+	res := db[songId] + 1
+	db[songId] = res
 
-func ReadNumZham(filePath string, songId string) (int, error) {
-	data, err := os.ReadFile(filePath)
+	newDb, err := json.MarshalIndent(db, "", " ")
 	if err != nil {
 		return 0, err
 	}
 
-	var db map[string]int
-	if err := json.Unmarshal(data, &db); err != nil {
+	if err := writeFileAtomic(filePath, newDb); err != nil {
 		return 0, err
 	}
 
-	return db[songId], nil
+	return res, nil
 }
 
-func WriteToZhamJSON(filePath string, songId string) (int, error) {
+// DeleteFromZhamJSON drops the counter of songId. Unknown IDs are not an error.
+func DeleteFromZhamJSON(filePath string, songId string) (err error) {
+	defer wrapStorageErr("delete zham count", &err)
+
+	unlock, err := lockFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
 	data, err := os.ReadFile(filePath)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	var db map[string]int
 	if err := json.Unmarshal(data, &db); err != nil {
-		return 0, err
+		return err
+	}
+	if db == nil {
+		// the file holds null
+		db = map[string]int{}
 	}
 
-	res := db[songId] + 1
-	db[songId] = res
+	if _, ok := db[songId]; !ok {
+		return nil
+	}
+	delete(db, songId)
 
 	newDb, err := json.MarshalIndent(db, "", " ")
 	if err != nil {
-		return 0, err
-	}
-
-	if err := os.WriteFile(filePath, newDb, 0644); err != nil {
-		return 0, err
+		return err
 	}
 
-	return res, nil
+	return writeFileAtomic(filePath, newDb)
 }
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestZhamJSONHoldingNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zham.json")
+
+	for _, step := range []struct {
+		name string
+		run  func() error
+	}{
+		{"read", func() error {
+			if _, err := ReadNumZham(path, "song1"); !errors.Is(err, ErrNotFound) {
+				return err
+			}
+			return nil
+		}},
+		{"delete", func() error { return DeleteFromZhamJSON(path, "song1") }},
+		{"write", func() error {
+			cnt, err := WriteToZhamJSON(path, "song1")
+			if err == nil && cnt != 1 {
+				t.Errorf("count after the first write = %d, want 1", cnt)
+			}
+			return err
+		}},
+	} {
+		if err := os.WriteFile(path, []byte("null"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := step.run(); err != nil {
+			t.Errorf("%s of a null zham file: %v", step.name, err)
+		}
+	}
+
+	if cnt, err := ReadNumZham(path, "song1"); err != nil || cnt != 1 {
+		t.Errorf("ReadNumZham after the write = %d, %v, want 1", cnt, err)
+	}
+}
@@ -0,0 +1,91 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileMutexes serializes writers of the same file inside this process, the
+// lock file held alongside serializes them across processes.
+var fileMutexes sync.Map
+
+// lockFile takes the in-process and the cross-process lock guarding path and
+// returns the function releasing both. Every read-modify-write of a shared
+// JSON file must happen between the two.
+func lockFile(path string) (func(), error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	mu, _ := fileMutexes.LoadOrStore(abs, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+
+	lock, err := os.OpenFile(abs+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		mu.(*sync.Mutex).Unlock()
+		return nil, err
+	}
+
+	if err := lockExclusive(lock); err != nil {
+		lock.Close()
+		mu.(*sync.Mutex).Unlock()
+		return nil, err
+	}
+
+	return func() {
+		unlockExclusive(lock)
+		lock.Close()
+		mu.(*sync.Mutex).Unlock()
+	}, nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so readers never see a partially written file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir, making the files renamed into it
+// durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
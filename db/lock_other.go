@@ -0,0 +1,19 @@
+//go:build !unix
+
+package db
+
+import "os"
+
+// Without flock only the in-process mutex of lockFile applies.
+
+func lockExclusive(f *os.File) error {
+	return nil
+}
+
+func unlockExclusive(f *os.File) error {
+	return nil
+}
+
+func tryLockExclusive(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"zham-app/models"
+)
+
+const (
+	writers         = 16
+	writesPerWriter = 10
+)
+
+// hammer runs fn from writers goroutines writesPerWriter times each.
+func hammer(fn func(writer, i int)) {
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writesPerWriter; i++ {
+				fn(w, i)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentZhamCounts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zham.json")
+	if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hammer(func(w, i int) {
+		// every writer bumps a shared counter and its own
+		for _, id := range []string{"shared", fmt.Sprintf("song%d", w)} {
+			if _, err := WriteToZhamJSON(path, id); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+
+	if cnt, err := ReadNumZham(path, "shared"); err != nil || cnt != writers*writesPerWriter {
+		t.Errorf("shared count = %d, %v; want %d", cnt, err, writers*writesPerWriter)
+	}
+	for w := 0; w < writers; w++ {
+		id := fmt.Sprintf("song%d", w)
+		if cnt, err := ReadNumZham(path, id); err != nil || cnt != writesPerWriter {
+			t.Errorf("%s count = %d, %v; want %d", id, cnt, err, writesPerWriter)
+		}
+	}
+}
+
+func TestConcurrentSongPuts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "songs.json")
+
+	// two stores on one file stand in for the server and the CLI, which only
+	// share the file lock
+	var stores [2]*SongStore
+	for i := range stores {
+		store, err := OpenSongStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores[i] = store
+	}
+
+	hammer(func(w, i int) {
+		song := models.Song{ID: fmt.Sprintf("song%d-%d", w, i), Title: fmt.Sprint(w, i)}
+		if err := stores[w%len(stores)].Put(song); err != nil {
+			t.Error(err)
+		}
+	})
+
+	reopened, err := OpenSongStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(reopened.All()); got != writers*writesPerWriter {
+		t.Errorf("catalogue holds %d songs, want %d", got, writers*writesPerWriter)
+	}
+	for w := 0; w < writers; w++ {
+		for i := 0; i < writesPerWriter; i++ {
+			id := fmt.Sprintf("song%d-%d", w, i)
+			if song, ok := reopened.Get(id); !ok || song.Title != fmt.Sprint(w, i) {
+				t.Errorf("%s = %+v, %v", id, song, ok)
+			}
+		}
+	}
+}
+
+func TestConcurrentShardWrites(t *testing.T) {
+	dir := t.TempDir()
+	// small shards so writers also race on creating new ones
+	shards := NewShardManager(dir, 4<<10)
+
+	hammer(func(w, i int) {
+		songID := fmt.Sprintf("song%d-%d", w, i)
+		fingerprints := map[uint32][]models.Couple{}
+		for a := uint32(0); a < 8; a++ {
+			fingerprints[a] = []models.Couple{{AnchorTimeMs: uint32(w*100 + i), SongID: songID}}
+		}
+		if err := shards.Write(fingerprints); err != nil {
+			t.Error(err)
+		}
+	})
+
+	all, err := shards.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for a := uint32(0); a < 8; a++ {
+		seen := map[string]bool{}
+		for _, entry := range all[a] {
+			seen[entry] = true
+		}
+		if len(all[a]) != writers*writesPerWriter || len(seen) != len(all[a]) {
+			t.Errorf("address %d holds %d entries, %d distinct; want %d", a, len(all[a]), len(seen), writers*writesPerWriter)
+		}
+	}
+}
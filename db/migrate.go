@@ -0,0 +1,153 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"zham-app/models"
+)
+
+var shardNameRe = regexp.MustCompile(`^db(\d*)\.json$`)
+
+// FindJSONShards lists the db.json, db2.json, ... shards present in dir, in
+// shard order. Missing shards are simply left out.
+func FindJSONShards(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type shard struct {
+		path string
+		num  int
+	}
+	var shards []shard
+	for _, entry := range entries {
+		m := shardNameRe.FindStringSubmatch(entry.Name())
+		if m == nil || entry.IsDir() {
+			continue
+		}
+		// db.json is the first shard
+		num := 1
+		if m[1] != "" {
+			num, _ = strconv.Atoi(m[1])
+		}
+		shards = append(shards, shard{path: filepath.Join(dir, entry.Name()), num: num})
+	}
+	sort.Slice(shards, func(i, j int) bool { return shards[i].num < shards[j].num })
+
+	paths := make([]string, len(shards))
+	for i, s := range shards {
+		paths[i] = s.path
+	}
+	return paths, nil
+}
+
+// MalformedEntry is a shard entry that isn't a valid "songId#anchorMs" couple.
+type MalformedEntry struct {
+	Shard   string
+	Address uint32
+	Entry   string
+}
+
+// MigrationReport describes what MigrateJSONShards imported.
+type MigrationReport struct {
+	Shards []string
+	// Songs is the number of couples imported per song
+	Songs      map[string]int
+	Duplicates int
+	Malformed  []MalformedEntry
+	// Skipped lists songs left alone because the target already holds them
+	Skipped []string
+}
+
+// MigrateJSONShards imports the couples of the given JSON shards into store.
+// Entries are validated and deduplicated, and songs the store already holds
+// are skipped so running a migration twice doesn't duplicate anything.
+func MigrateJSONShards(shards []string, store Store) (_ *MigrationReport, err error) {
+	defer wrapStorageErr("migrate", &err)
+
+	existing := map[string]bool{}
+	err = store.Scan(func(address uint32, couples []models.Couple) error {
+		for _, c := range couples {
+			existing[c.SongID] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	report := &MigrationReport{Shards: shards, Songs: map[string]int{}}
+
+	type key struct {
+		address uint32
+		couple  models.Couple
+	}
+	seen := map[key]bool{}
+	skipped := map[string]bool{}
+	fingerprints := map[uint32][]models.Couple{}
+
+	for _, path := range shards {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var shard map[uint32][]string
+		if err := json.Unmarshal(data, &shard); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+
+		// map order is random, keep the report stable within a shard
+		var malformed []MalformedEntry
+		for address, entries := range shard {
+			for _, entry := range entries {
+				couple, err := ParseCouple(entry)
+				if err != nil {
+					malformed = append(malformed, MalformedEntry{Shard: path, Address: address, Entry: entry})
+					continue
+				}
+				if existing[couple.SongID] {
+					skipped[couple.SongID] = true
+					continue
+				}
+
+				k := key{address: address, couple: couple}
+				if seen[k] {
+					report.Duplicates++
+					continue
+				}
+				seen[k] = true
+
+				fingerprints[address] = append(fingerprints[address], couple)
+				report.Songs[couple.SongID]++
+			}
+		}
+
+		sort.Slice(malformed, func(i, j int) bool {
+			if malformed[i].Address != malformed[j].Address {
+				return malformed[i].Address < malformed[j].Address
+			}
+			return malformed[i].Entry < malformed[j].Entry
+		})
+		report.Malformed = append(report.Malformed, malformed...)
+	}
+
+	for songID := range skipped {
+		report.Skipped = append(report.Skipped, songID)
+	}
+	sort.Strings(report.Skipped)
+
+	if len(fingerprints) > 0 {
+		if err := store.Put(fingerprints); err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,239 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"zham-app/models"
+)
+
+// A segment is an immutable posting file written by DiskStore.Put:
+//
+//	header   magic "ZSEG", version, numAddresses, dictionary length
+//	songs    SongDict.MarshalBinary
+//	index    numAddresses × (address, postings offset, postings length), sorted by address
+//	postings one EncodePostings block per address
+//
+// All header and index integers are little-endian uint32, offsets and lengths
+// are in bytes relative to the start of the postings. The header, songs and
+// index are loaded when the segment is opened, postings are read on demand.
+const (
+	segmentMagic   = "ZSEG"
+	segmentVersion = 2
+
+	indexEntrySize = 12
+)
+
+var errBadSegment = errors.New("malformed segment file")
+
+type segment struct {
+	path string
+	file *os.File
+	dict *SongDict
+
+	addresses []uint32
+	offsets   []uint32
+	lengths   []uint32
+
+	postingsOffset int64
+}
+
+func writeSegment(path string, fingerprints map[uint32][]models.Couple) error {
+	addresses := make([]uint32, 0, len(fingerprints))
+	for address, couples := range fingerprints {
+		if len(couples) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Slice(addresses, func(i, j int) bool { return addresses[i] < addresses[j] })
+
+	dict := NewSongDict()
+	var postings []byte
+	index := make([]byte, 0, len(addresses)*indexEntrySize)
+	for _, address := range addresses {
+		start := len(postings)
+		postings = EncodePostings(postings, fingerprints[address], dict)
+		index = binary.LittleEndian.AppendUint32(index, address)
+		index = binary.LittleEndian.AppendUint32(index, uint32(start))
+		index = binary.LittleEndian.AppendUint32(index, uint32(len(postings)-start))
+	}
+
+	songs, err := dict.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	buf := []byte(segmentMagic)
+	buf = binary.LittleEndian.AppendUint32(buf, segmentVersion)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(addresses)))
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(len(songs)))
+	buf = append(buf, songs...)
+	buf = append(buf, index...)
+	buf = append(buf, postings...)
+
+	// write under a temporary name so a crash never leaves a half written
+	// segment, and make it durable before a manifest can list it
+	tmpPath := path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func openSegment(path string) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seg, err := readSegmentHeader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	seg.path = path
+	seg.file = file
+
+	return seg, nil
+}
+
+func readSegmentHeader(file *os.File) (*segment, error) {
+	r := bufio.NewReader(file)
+
+	var header [16]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, errBadSegment
+	}
+	if string(header[0:4]) != segmentMagic {
+		return nil, errBadSegment
+	}
+
+	if version := binary.LittleEndian.Uint32(header[4:8]); version != segmentVersion {
+		return nil, fmt.Errorf("unsupported segment version %d", version)
+	}
+	numAddresses := binary.LittleEndian.Uint32(header[8:12])
+	dictLen := binary.LittleEndian.Uint32(header[12:16])
+
+	songs := make([]byte, dictLen)
+	if _, err := io.ReadFull(r, songs); err != nil {
+		return nil, errBadSegment
+	}
+	seg := &segment{dict: NewSongDict()}
+	if err := seg.dict.UnmarshalBinary(songs); err != nil {
+		return nil, err
+	}
+	offset := int64(len(header)) + int64(dictLen)
+
+	seg.addresses = make([]uint32, numAddresses)
+	seg.offsets = make([]uint32, numAddresses)
+	seg.lengths = make([]uint32, numAddresses)
+
+	var entry [indexEntrySize]byte
+	for i := range seg.addresses {
+		if _, err := io.ReadFull(r, entry[:]); err != nil {
+			return nil, errBadSegment
+		}
+		seg.addresses[i] = binary.LittleEndian.Uint32(entry[0:4])
+		seg.offsets[i] = binary.LittleEndian.Uint32(entry[4:8])
+		seg.lengths[i] = binary.LittleEndian.Uint32(entry[8:12])
+	}
+	offset += int64(numAddresses) * indexEntrySize
+
+	seg.postingsOffset = offset
+	return seg, nil
+}
+
+// hasSong tells DeleteSong whether the segment needs rewriting.
+func (s *segment) hasSong(songID string) bool {
+	_, ok := s.dict.Lookup(songID)
+	return ok
+}
+
+// lookup reads the couples stored under address, if any.
+func (s *segment) lookup(address uint32) ([]models.Couple, error) {
+	i := sort.Search(len(s.addresses), func(i int) bool { return s.addresses[i] >= address })
+	if i == len(s.addresses) || s.addresses[i] != address {
+		return nil, nil
+	}
+
+	buf := make([]byte, s.lengths[i])
+	if _, err := s.file.ReadAt(buf, s.postingsOffset+int64(s.offsets[i])); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	return s.decodePostings(buf)
+}
+
+func (s *segment) decodePostings(buf []byte) ([]models.Couple, error) {
+	couples, _, err := DecodePostings(buf, s.dict)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return couples, nil
+}
+
+// scan reads all postings of the segment in one go and calls fn per address.
+func (s *segment) scan(fn func(address uint32, couples []models.Couple) error) error {
+	if len(s.addresses) == 0 {
+		return nil
+	}
+
+	last := len(s.addresses) - 1
+	buf := make([]byte, int(s.offsets[last])+int(s.lengths[last]))
+	if _, err := s.file.ReadAt(buf, s.postingsOffset); err != nil {
+		return fmt.Errorf("%s: %w", s.path, err)
+	}
+
+	for i, address := range s.addresses {
+		start := int(s.offsets[i])
+		end := start + int(s.lengths[i])
+		if end > len(buf) {
+			return fmt.Errorf("%s: %w", s.path, errBadSegment)
+		}
+		couples, err := s.decodePostings(buf[start:end])
+		if err != nil {
+			return err
+		}
+		if err := fn(address, couples); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readAll loads every couple of the segment, used when rewriting or merging.
+func (s *segment) readAll() (map[uint32][]models.Couple, error) {
+	res := make(map[uint32][]models.Couple, len(s.addresses))
+	err := s.scan(func(address uint32, couples []models.Couple) error {
+		res[address] = couples
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *segment) close() error {
+	return s.file.Close()
+}
@@ -0,0 +1,305 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"zham-app/models"
+)
+
+const (
+	// manifestName is the file, next to the shards, recording which shards
+	// exist and which songs live in them. Its lock guards the whole set.
+	manifestName = "shards.json"
+
+	DefaultMaxShardBytes = 64 << 20
+)
+
+// ShardManager owns the db*.json shards of the JSON backend. Songs are
+// appended to the newest shard until it would grow past maxBytes, then a new
+// shard is created; a manifest maps every song to the shards holding its
+// couples so deletes only rewrite those.
+type ShardManager struct {
+	dir      string
+	maxBytes int64
+}
+
+type shardManifest struct {
+	// Shards are file names relative to the shard directory, oldest first
+	Shards []string
+	Songs  map[string][]string
+}
+
+func NewShardManager(dir string, maxBytes int64) *ShardManager {
+	if maxBytes <= 0 {
+		maxBytes = DefaultMaxShardBytes
+	}
+	return &ShardManager{dir: dir, maxBytes: maxBytes}
+}
+
+func (m *ShardManager) lock() (func(), error) {
+	return lockFile(filepath.Join(m.dir, manifestName))
+}
+
+// loadManifest reads the manifest, or builds one from the shards found in the
+// directory when there is none yet (stores written before the manifest).
+func (m *ShardManager) loadManifest() (*shardManifest, error) {
+	data, err := os.ReadFile(filepath.Join(m.dir, manifestName))
+	if err == nil {
+		manifest := &shardManifest{}
+		if err := json.Unmarshal(data, manifest); err != nil {
+			return nil, fmt.Errorf("%s: %v", manifestName, err)
+		}
+		if manifest.Songs == nil {
+			manifest.Songs = map[string][]string{}
+		}
+		return manifest, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	paths, err := FindJSONShards(m.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &shardManifest{Songs: map[string][]string{}}
+	for _, path := range paths {
+		name := filepath.Base(path)
+		shard, err := readShard(path)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Shards = append(manifest.Shards, name)
+		for _, entries := range shard {
+			for _, entry := range entries {
+				if couple, err := ParseCouple(entry); err == nil {
+					manifest.addSong(couple.SongID, name)
+				}
+			}
+		}
+	}
+	return manifest, nil
+}
+
+func (m *ShardManager) writeManifest(manifest *shardManifest) error {
+	data, err := json.MarshalIndent(manifest, "", " ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(m.dir, manifestName), data)
+}
+
+func (manifest *shardManifest) addSong(songID string, shard string) {
+	for _, s := range manifest.Songs[songID] {
+		if s == shard {
+			return
+		}
+	}
+	manifest.Songs[songID] = append(manifest.Songs[songID], shard)
+}
+
+// nextShard names the shard after the highest numbered one, db.json being
+// shard 1.
+func (manifest *shardManifest) nextShard() string {
+	highest := 0
+	for _, name := range manifest.Shards {
+		num := 0
+		if sm := shardNameRe.FindStringSubmatch(name); sm != nil {
+			num = 1
+			if sm[1] != "" {
+				num, _ = strconv.Atoi(sm[1])
+			}
+		}
+		highest = max(highest, num)
+	}
+	if highest == 0 {
+		return "db.json"
+	}
+	return fmt.Sprintf("db%d.json", highest+1)
+}
+
+// readShard reads one shard. A missing shard reads as empty.
+func readShard(path string) (map[uint32][]string, error) {
+	shard := map[uint32][]string{}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return shard, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &shard); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return shard, nil
+}
+
+// ReadAll merges the entries of every shard in the manifest.
+func (m *ShardManager) ReadAll() (map[uint32][]string, error) {
+	unlock, err := m.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	manifest, err := m.loadManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make(map[uint32][]string)
+	for _, name := range manifest.Shards {
+		shard, err := readShard(filepath.Join(m.dir, name))
+		if err != nil {
+			return nil, err
+		}
+		for address, couples := range shard {
+			res[address] = append(res[address], couples...)
+		}
+	}
+
+	return res, nil
+}
+
+// Write appends fingerprints to the newest shard, or to a new one if the
+// newest would grow past the size limit. A single write larger than the limit
+// still goes to one shard, so a song is never split.
+func (m *ShardManager) Write(fingerprints map[uint32][]models.Couple) error {
+	entries := map[uint32][]string{}
+	songs := map[string]bool{}
+	for address, couples := range fingerprints {
+		for _, c := range couples {
+			entries[address] = append(entries[address], c.SongID+"#"+fmt.Sprint(c.AnchorTimeMs))
+			songs[c.SongID] = true
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	manifest, err := m.loadManifest()
+	if err != nil {
+		return err
+	}
+
+	var name string
+	var shard map[uint32][]string
+	if n := len(manifest.Shards); n > 0 {
+		name = manifest.Shards[n-1]
+		path := filepath.Join(m.dir, name)
+		if info, err := os.Stat(path); os.IsNotExist(err) || (err == nil && info.Size()+estimateShardBytes(entries) <= m.maxBytes) {
+			if shard, err = readShard(path); err != nil {
+				return err
+			}
+		}
+	}
+	if shard == nil {
+		name = manifest.nextShard()
+		manifest.Shards = append(manifest.Shards, name)
+		shard = map[uint32][]string{}
+	}
+
+	for address, couples := range entries {
+		shard[address] = append(shard[address], couples...)
+	}
+
+	data, err := json.MarshalIndent(shard, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(m.dir, name), data); err != nil {
+		return err
+	}
+
+	for songID := range songs {
+		manifest.addSong(songID, name)
+	}
+	return m.writeManifest(manifest)
+}
+
+// estimateShardBytes approximates how much entries add to an indented shard.
+func estimateShardBytes(entries map[uint32][]string) int64 {
+	var n int64
+	for _, couples := range entries {
+		// key line, brackets and indentation
+		n += 24
+		for _, c := range couples {
+			n += int64(len(c)) + 8
+		}
+	}
+	return n
+}
+
+// DeleteSong drops every entry of songID from the shards the manifest lists
+// for it. Unknown songs are not an error.
+func (m *ShardManager) DeleteSong(songID string) error {
+	unlock, err := m.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	manifest, err := m.loadManifest()
+	if err != nil {
+		return err
+	}
+
+	names, ok := manifest.Songs[songID]
+	if !ok {
+		return nil
+	}
+
+	for _, name := range names {
+		path := filepath.Join(m.dir, name)
+		shard, err := readShard(path)
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for address, couples := range shard {
+			kept := couples[:0]
+			for _, c := range couples {
+				// IDs may contain '#', so "a" must not take "a#b#120" with it
+				if couple, err := ParseCouple(c); err != nil || couple.SongID != songID {
+					kept = append(kept, c)
+				}
+			}
+			if len(kept) != len(couples) {
+				changed = true
+				if len(kept) == 0 {
+					delete(shard, address)
+				} else {
+					shard[address] = kept
+				}
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		data, err := json.MarshalIndent(shard, "", " ")
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+
+	delete(manifest.Songs, songID)
+	return m.writeManifest(manifest)
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+
+	"zham-app/models"
+)
+
+func TestShardDeleteSongExactID(t *testing.T) {
+	shards := NewShardManager(t.TempDir(), DefaultMaxShardBytes)
+
+	// "a" is a prefix of the other IDs up to their '#'
+	err := shards.Write(map[uint32][]models.Couple{
+		1: {{AnchorTimeMs: 10, SongID: "a"}, {AnchorTimeMs: 20, SongID: "a#b"}, {AnchorTimeMs: 30, SongID: "a#1"}},
+		2: {{AnchorTimeMs: 40, SongID: "a"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := shards.DeleteSong("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	all, err := shards.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[uint32][]string{1: {"a#b#20", "a#1#30"}}
+	if !reflect.DeepEqual(all, want) {
+		t.Errorf("after deleting a: %v, want %v", all, want)
+	}
+}
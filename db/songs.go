@@ -0,0 +1,142 @@
+package db
+
+import (
+	"encoding/json"
+	"os"
+	"sort"
+	"sync"
+	"zham-app/models"
+)
+
+// SongStore is the song catalogue: metadata for every ingested song, kept in
+// a JSON file keyed by song ID and cached in memory.
+type SongStore struct {
+	mu       sync.RWMutex
+	filePath string
+	songs    map[string]models.Song
+}
+
+// OpenSongStore loads the catalogue at filePath, starting empty if the file
+// doesn't exist yet.
+func OpenSongStore(filePath string) (_ *SongStore, err error) {
+	defer wrapStorageErr("open catalogue", &err)
+
+	songs, err := readSongs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return &SongStore{filePath: filePath, songs: songs}, nil
+}
+
+func readSongs(filePath string) (map[string]models.Song, error) {
+	songs := map[string]models.Song{}
+
+	data, err := os.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		return songs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &songs); err != nil {
+		return nil, err
+	}
+	return songs, nil
+}
+
+func (s *SongStore) Get(songID string) (models.Song, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	song, ok := s.songs[songID]
+	return song, ok
+}
+
+// All returns every song sorted by ID.
+func (s *SongStore) All() []models.Song {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make([]models.Song, 0, len(s.songs))
+	for _, song := range s.songs {
+		res = append(res, song)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].ID < res[j].ID })
+	return res
+}
+
+// Put adds or replaces song and writes the catalogue back to disk.
+func (s *SongStore) Put(song models.Song) (err error) {
+	defer wrapStorageErr("save song", &err)
+
+	return s.update(func(songs map[string]models.Song) bool {
+		songs[song.ID] = song
+		return true
+	})
+}
+
+// PutMany adds or replaces several songs with a single write.
+func (s *SongStore) PutMany(batch []models.Song) (err error) {
+	defer wrapStorageErr("save songs", &err)
+
+	return s.update(func(songs map[string]models.Song) bool {
+		for _, song := range batch {
+			songs[song.ID] = song
+		}
+		return len(batch) > 0
+	})
+}
+
+// Delete removes songIDs from the catalogue with a single write. Unknown IDs
+// are not an error.
+func (s *SongStore) Delete(songIDs ...string) (err error) {
+	defer wrapStorageErr("delete song", &err)
+
+	return s.update(func(songs map[string]models.Song) bool {
+		changed := false
+		for _, songID := range songIDs {
+			if _, ok := songs[songID]; ok {
+				delete(songs, songID)
+				changed = true
+			}
+		}
+		return changed
+	})
+}
+
+// update applies change to the catalogue under the file lock. The file is
+// re-read first so songs written by another process (e.g. the CLI) aren't
+// lost, and the cache only changes once the new file is in place. change
+// reports whether it modified anything.
+func (s *SongStore) update(change func(songs map[string]models.Song) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	unlock, err := lockFile(s.filePath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	songs, err := readSongs(s.filePath)
+	if err != nil {
+		return err
+	}
+
+	if !change(songs) {
+		s.songs = songs
+		return nil
+	}
+
+	data, err := json.MarshalIndent(songs, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.filePath, data); err != nil {
+		return err
+	}
+
+	s.songs = songs
+	return nil
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"zham-app/models"
+)
+
+const (
+	BackendJSON = "json"
+	BackendDisk = "disk"
+)
+
+// ErrNotFound is returned when a song isn't known to the catalogue or counters.
+var ErrNotFound = errors.New("db: not found")
+
+// ErrLocked is returned when opening a store another process already has open.
+var ErrLocked = errors.New("db: store is in use by another process")
+
+// StorageError wraps a failure to read or write persisted data, so callers can
+// tell it apart from bad input.
+type StorageError struct {
+	Op  string
+	Err error
+}
+
+func (e *StorageError) Error() string {
+	return fmt.Sprintf("db: %s: %v", e.Op, e.Err)
+}
+
+func (e *StorageError) Unwrap() error {
+	return e.Err
+}
+
+// wrapStorageErr is deferred by the exported store methods to wrap whatever
+// they return, other than ErrNotFound, in a StorageError.
+func wrapStorageErr(op string, err *error) {
+	if *err != nil && !errors.Is(*err, ErrNotFound) {
+		var storageErr *StorageError
+		if !errors.As(*err, &storageErr) {
+			*err = &StorageError{Op: op, Err: *err}
+		}
+	}
+}
+
+// Store persists fingerprint couples keyed by their uint32 address.
+type Store interface {
+	// Put adds the couples of one or more songs.
+	Put(fingerprints map[uint32][]models.Couple) error
+	// Lookup returns the couples stored under each address, in the order the
+	// addresses were given.
+	Lookup(addresses []uint32) ([]Res, error)
+	// DeleteSong removes every couple belonging to songID.
+	DeleteSong(songID string) error
+	// Scan calls fn with the couples of every stored address, in no
+	// particular order. It stops at the first error fn returns.
+	Scan(fn func(address uint32, couples []models.Couple) error) error
+	// Profile returns the fingerprint profile recorded with SetProfile, or
+	// nil if none was. The store treats it as opaque.
+	Profile() ([]byte, error)
+	SetProfile(profile []byte) error
+	Close() error
+}
+
+// readProfile reads a profile file, nil if it doesn't exist.
+func readProfile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Config selects and configures the Store returned by Open.
+type Config struct {
+	Backend string
+	// Path is the directory holding the segments of BackendDisk or the shards
+	// of BackendJSON. Empty picks "zhamdb" and the working directory
+	// respectively.
+	Path string
+	// MaxShardBytes caps the size of a BackendJSON shard, zero picks
+	// DefaultMaxShardBytes.
+	MaxShardBytes int64
+}
+
+func Open(cfg Config) (Store, error) {
+	switch cfg.Backend {
+	case BackendDisk:
+		if cfg.Path == "" {
+			cfg.Path = "zhamdb"
+		}
+		return OpenDiskStore(cfg.Path)
+	case BackendJSON:
+		if cfg.Path == "" {
+			cfg.Path = "."
+		}
+		return OpenJSONStore(cfg.Path, cfg.MaxShardBytes)
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", cfg.Backend)
+	}
+}
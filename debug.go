@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image/png"
+	"net/http"
+	"strconv"
+
+	"zham-app/config"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/plot"
+	"zham-app/wav"
+	"zham-app/zham"
+)
+
+const (
+	// spectrogram plots get a column per frame within these bounds
+	minPlotWidth = 320
+	maxPlotWidth = 1600
+	plotHeight   = 512
+)
+
+// debugSpectrogramFile renders the spectrogram of a file on the server, given
+// by the file query parameter relative to the batch root, as a PNG. With
+// match=1 the file is also searched like a query and the hashes that matched
+// the top candidate are drawn over it.
+func debugSpectrogramFile(cfg *config.Config, store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("file") == "" {
+			writeError(w, badRequest(errors.New("missing file query parameter")))
+			return
+		}
+		path, err := resolveBatchPath(cfg.Server.BatchRoot, query.Get("file"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		samples, rate, err := wav.DecodeFile(path)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		samples, err = cfg.Fingerprint.Resample(samples, rate)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		match, _ := strconv.ParseBool(query.Get("match"))
+		writeSpectrogram(cfg, store, w, samples, match)
+	}
+}
+
+// debugSpectrogramQuery renders the spectrogram of a query, sent in any of the
+// forms POST /zham takes, with the hashes that matched the top candidate drawn
+// over it.
+func debugSpectrogramQuery(cfg *config.Config, store db.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		samples, _, err := querySamples(cfg, w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeSpectrogram(cfg, store, w, samples, true)
+	}
+}
+
+// writeSpectrogram answers with the PNG of samples at the profile's sample
+// rate: the spectrogram in dB, its constellation peaks and, with match set,
+// the aligned hashes of the top candidate as anchor to target lines. The
+// candidate is named in the X-Zham-Match and X-Zham-Confident headers.
+func writeSpectrogram(cfg *config.Config, store db.Store, w http.ResponseWriter, samples []float64, match bool) {
+	p := cfg.Fingerprint
+	duration := float64(len(samples)) / float64(p.SampleRate)
+	frames := int(duration * float64(p.SampleRate/p.DSPRatio) / float64(p.HopSize))
+	bins := p.FreqBinSize / 2
+	spectrogram := plot.NewSpectrogram(
+		duration,
+		float64(p.SampleRate/p.DSPRatio)/2,
+		bins,
+		min(max(frames, minPlotWidth), maxPlotWidth),
+		min(bins, plotHeight),
+	)
+
+	peaks, err := p.Analyze(samples, spectrogram.Add)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var pairs []plot.Pair
+	if match {
+		fingerprints, numTargetZones := p.Fingerprint(peaks, "")
+		if len(fingerprints) == 0 {
+			writeError(w, zham.ErrNoFingerprints)
+			return
+		}
+		matches, err := findMatches(cfg, store, fingerprints, numTargetZones)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if len(matches) > 0 {
+			top := matches[0]
+			w.Header().Set("X-Zham-Match", top.SongID)
+			w.Header().Set("X-Zham-Confident", strconv.FormatBool(top.Confident))
+			pairs = hashPairs(top.Aligned())
+		}
+	}
+
+	// encode first so a failure can still be answered with the JSON envelope
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, spectrogram.Image(peaks, pairs)); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", fmt.Sprint(buf.Len()))
+	w.Write(buf.Bytes())
+}
+
+// hashPairs recovers the anchor and target peaks of query hashes from their
+// addresses.
+func hashPairs(hashes []zham.QueryHash) []plot.Pair {
+	pairs := make([]plot.Pair, len(hashes))
+	for i, hash := range hashes {
+		anchorFreq, targetFreq, deltaMs := zham.UnpackAddress(hash.Address)
+		pairs[i] = plot.Pair{
+			Anchor: models.Peak{Time: float64(hash.AnchorTimeMs) / 1000, Freq: int32(anchorFreq)},
+			Target: models.Peak{Time: float64(int(hash.AnchorTimeMs)+deltaMs) / 1000, Freq: int32(targetFreq)},
+		}
+	}
+	return pairs
+}
+
+// queryDebug is what POST /zham?debug=1 adds to the response: the
+// constellation of the query, its hashes and how every candidate was scored.
+type queryDebug struct {
+	Peaks []models.Peak
+	// Hashes counts the fingerprints of the query, Addresses the distinct
+	// addresses among them.
+	Hashes         int
+	Addresses      int
+	NumTargetZones int
+	Candidates     []candidateDebug
+}
+
+type candidateDebug struct {
+	SongID string
+	zham.MatchDebug
+}
+
+// debugRequested reports whether the request asks for the debug response,
+// which is refused unless server.debug is set.
+func debugRequested(cfg *config.Config, r *http.Request) (bool, error) {
+	value := r.URL.Query().Get("debug")
+	if value == "" {
+		return false, nil
+	}
+	debug, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, badRequest(fmt.Errorf("invalid debug %q", value))
+	}
+	if debug && !cfg.Server.Debug {
+		return false, &apiError{status: http.StatusForbidden, err: errors.New("debug responses are disabled, see server.debug")}
+	}
+	return debug, nil
+}
+
+func newQueryDebug(peaks []models.Peak, fingerprints map[uint32][]models.Couple, numTargetZones int, matches []zham.Match) *queryDebug {
+	debug := &queryDebug{
+		Peaks:          peaks,
+		Addresses:      len(fingerprints),
+		NumTargetZones: numTargetZones,
+		Candidates:     make([]candidateDebug, len(matches)),
+	}
+	for _, couples := range fingerprints {
+		debug.Hashes += len(couples)
+	}
+	for i, match := range matches {
+		debug.Candidates[i] = candidateDebug{SongID: match.SongID, MatchDebug: match.Debug()}
+	}
+	return debug
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"zham-app/db"
+	"zham-app/wav"
+	"zham-app/zham"
+)
+
+// apiError pins the HTTP status an error is reported with, for request
+// problems the handlers detect themselves.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string {
+	return e.err.Error()
+}
+
+func (e *apiError) Unwrap() error {
+	return e.err
+}
+
+func badRequest(err error) error {
+	return &apiError{status: http.StatusBadRequest, err: err}
+}
+
+type errorBody struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+// errorResponse is the envelope every failed request is answered with.
+type errorResponse struct {
+	Error errorBody
+}
+
+// statusFor maps the typed errors of the wav, zham and db packages onto HTTP
+// status codes. Anything unrecognised is a 500.
+func statusFor(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	var apiErr *apiError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return http.StatusRequestEntityTooLarge
+	case errors.As(err, &apiErr):
+		return apiErr.status
+	case errors.Is(err, wav.ErrMissingAudio),
+		errors.Is(err, zham.ErrTooShort),
+		errors.Is(err, zham.ErrNoFingerprints):
+		return http.StatusBadRequest
+	case wav.IsDecodeError(err):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, db.ErrNotFound):
+		return http.StatusNotFound
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError answers the request with the JSON error envelope. Details of
+// server side failures are logged rather than sent to the client.
+func writeError(w http.ResponseWriter, err error) {
+	body := errorBodyFor(err)
+	w.WriteHeader(body.Status)
+	json.NewEncoder(w).Encode(errorResponse{Error: body})
+}
+
+func errorBodyFor(err error) errorBody {
+	status := statusFor(err)
+
+	message := err.Error()
+	if status >= http.StatusInternalServerError {
+		log.Println("error:", err)
+		message = http.StatusText(status)
+	}
+
+	return errorBody{
+		Status:  status,
+		Code:    http.StatusText(status),
+		Message: message,
+	}
+}
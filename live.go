@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"zham-app/config"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/resample"
+	"zham-app/wav"
+	"zham-app/ws"
+	"zham-app/zham"
+)
+
+// liveStart is the first message of a live session, declaring the PCM the
+// client is about to stream. Channels defaults to 1 and Encoding to s16le.
+type liveStart struct {
+	SampleRate int
+	Channels   int
+	Encoding   string
+}
+
+// liveReady acknowledges liveStart.
+type liveReady struct {
+	Type       string
+	Profile    string
+	IntervalMs int
+}
+
+// liveUpdate carries the candidates after a match attempt. Type is
+// "candidates" while the session goes on, "match" once the top candidate is
+// confident and "end" when the session ended without a confident match.
+type liveUpdate struct {
+	Type       string
+	ElapsedSec float64
+	Matched    bool
+	Matches    []songMatch
+	ZhamCount  int
+}
+
+type liveError struct {
+	Type  string
+	Error errorBody
+}
+
+// liveControl is a text message sent after liveStart. {"Type":"end"} asks for
+// a final answer on the audio streamed so far.
+type liveControl struct {
+	Type string
+}
+
+// liveSession fingerprints PCM as it arrives. The spectrogram is computed
+// incrementally, peaks and hashes are redone over the whole session on every
+// match attempt since the peak threshold depends on all of the audio.
+type liveSession struct {
+	profile   zham.FingerprintProfile
+	format    wav.RawFormat
+	pending   []byte // partial frame carried over to the next message
+	resampler resample.Resampler
+	stream    *zham.SpectrogramStream
+	finder    *zham.PeakFinder
+	samples   int // at the profile's sample rate
+}
+
+func newLiveSession(profile zham.FingerprintProfile, format wav.RawFormat) (*liveSession, error) {
+	resampler, err := profile.NewResampler(format.SampleRate)
+	if err != nil {
+		return nil, err
+	}
+	return &liveSession{
+		profile:   profile,
+		format:    format,
+		resampler: resampler,
+		stream:    profile.NewSpectrogramStream(),
+		finder:    profile.NewPeakFinder(),
+	}, nil
+}
+
+func (s *liveSession) write(data []byte) error {
+	data = append(s.pending, data...)
+	whole := len(data) - len(data)%s.format.FrameSize()
+	s.pending = append([]byte(nil), data[whole:]...)
+
+	mono, err := s.format.Mono(data[:whole])
+	if err != nil {
+		return err
+	}
+	s.push(s.resampler.Write(mono))
+	return nil
+}
+
+// flush pushes the audio held back for the resampler and the downsampler.
+// Nothing may be written afterwards.
+func (s *liveSession) flush() error {
+	s.push(s.resampler.Flush())
+	s.stream.Flush()
+	s.drain()
+	return resample.Err(s.resampler)
+}
+
+// close stops the resampler if it runs in another process.
+func (s *liveSession) close() {
+	if closer, ok := s.resampler.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+func (s *liveSession) push(samples []float64) {
+	s.samples += len(samples)
+	s.stream.Write(samples)
+	s.drain()
+}
+
+func (s *liveSession) drain() {
+	for frame, ok := s.stream.Next(); ok; frame, ok = s.stream.Next() {
+		s.finder.Add(frame)
+	}
+}
+
+func (s *liveSession) elapsed() time.Duration {
+	return time.Duration(s.samples) * time.Second / time.Duration(s.profile.SampleRate)
+}
+
+// fingerprints returns the hashes of the session so far, their number of
+// target zones and the number of peaks they were made from.
+func (s *liveSession) fingerprints() (map[uint32][]models.Couple, int, int) {
+	peaks := s.finder.Peaks()
+	fingerprints, numTargetZones := s.profile.Fingerprint(peaks, "")
+	return fingerprints, numTargetZones, len(peaks)
+}
+
+// liveQuery matches audio streamed over a WebSocket. The client opens the
+// session with a liveStart text message and then sends raw PCM as binary
+// messages. Every cfg.Live.IntervalMs of audio the session is matched and the
+// candidates pushed; it ends as soon as the top candidate is confident, when
+// the client sends {"Type":"end"}, stays silent for cfg.Live.IdleTimeoutSec
+// or reaches cfg.Live.MaxDurationSec.
+func liveQuery(cfg *config.Config, store db.Store, songs *db.SongStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := ws.Upgrade(w, r)
+		if err != nil {
+			writeError(w, badRequest(err))
+			return
+		}
+		conn.ReadLimit = cfg.Live.MaxMessageBytes
+
+		if err := runLiveSession(cfg, store, songs, conn); err != nil {
+			var closeErr *ws.CloseError
+			if !errors.As(err, &closeErr) {
+				log.Println("live session:", err)
+			}
+		}
+	}
+}
+
+func runLiveSession(cfg *config.Config, store db.Store, songs *db.SongStore, conn *ws.Conn) error {
+	idle := time.Duration(cfg.Live.IdleTimeoutSec) * time.Second
+
+	conn.SetReadDeadline(time.Now().Add(idle))
+	opcode, data, err := conn.ReadMessage()
+	if err != nil {
+		return err
+	}
+
+	start := liveStart{Channels: 1, Encoding: "s16le"}
+	if opcode != ws.OpText {
+		err = errors.New("the first message must be the JSON stream format")
+	} else if err = json.Unmarshal(data, &start); err == nil {
+		err = wav.RawFormat(start).Validate()
+	}
+	if err != nil {
+		return failLiveSession(conn, ws.ClosePolicyViolation, badRequest(err))
+	}
+
+	session, err := newLiveSession(cfg.Fingerprint, wav.RawFormat(start))
+	if err != nil {
+		return failLiveSession(conn, ws.CloseInternalError, err)
+	}
+	defer session.close()
+
+	maxDuration := time.Duration(cfg.Live.MaxDurationSec) * time.Second
+	interval := time.Duration(cfg.Live.IntervalMs) * time.Millisecond
+
+	if err := conn.WriteJSON(liveReady{Type: "ready", Profile: cfg.Fingerprint.ID(), IntervalMs: cfg.Live.IntervalMs}); err != nil {
+		return err
+	}
+
+	lastAttempt := time.Duration(0)
+	for session.elapsed() < maxDuration {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		opcode, data, err := conn.ReadMessage()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if opcode == ws.OpText {
+			var control liveControl
+			if err := json.Unmarshal(data, &control); err != nil || control.Type != "end" {
+				return failLiveSession(conn, ws.ClosePolicyViolation, badRequest(fmt.Errorf("unexpected message %q", data)))
+			}
+			break
+		}
+
+		if err := session.write(data); err != nil {
+			return failLiveSession(conn, ws.CloseUnsupportedData, err)
+		}
+		if err := resample.Err(session.resampler); err != nil {
+			return failLiveSession(conn, ws.CloseInternalError, err)
+		}
+		if session.elapsed()-lastAttempt < interval {
+			continue
+		}
+		lastAttempt = session.elapsed()
+
+		update, err := matchLiveSession(cfg, store, songs, session, false)
+		if err != nil {
+			return failLiveSession(conn, ws.CloseInternalError, err)
+		}
+		if update == nil {
+			continue
+		}
+		if err := conn.WriteJSON(update); err != nil {
+			return err
+		}
+		if update.Matched {
+			return conn.Close(ws.CloseNormal, "matched")
+		}
+	}
+
+	if err := session.flush(); err != nil {
+		return failLiveSession(conn, ws.CloseInternalError, err)
+	}
+	update, err := matchLiveSession(cfg, store, songs, session, true)
+	if err != nil {
+		return failLiveSession(conn, ws.CloseInternalError, err)
+	}
+	if err := conn.WriteJSON(update); err != nil {
+		return err
+	}
+	return conn.Close(ws.CloseNormal, update.Type)
+}
+
+// matchLiveSession matches the audio streamed so far. It returns nil when
+// there is nothing to report yet, unless final is set.
+func matchLiveSession(cfg *config.Config, store db.Store, songs *db.SongStore, session *liveSession, final bool) (*liveUpdate, error) {
+	update := &liveUpdate{Type: "candidates", ElapsedSec: session.elapsed().Seconds()}
+	if final {
+		update.Type = "end"
+	}
+
+	fingerprints, numTargetZones, peaks := session.fingerprints()
+	if len(fingerprints) == 0 {
+		if final {
+			telemetry.query("live", peaks, fingerprints, nil)
+			return update, nil
+		}
+		return nil, nil
+	}
+
+	res, err := findMatches(cfg, store, fingerprints, numTargetZones)
+	if err != nil {
+		return nil, err
+	}
+
+	update.Matches = withSongs(songs, res)
+
+	if len(res) > 0 && res[0].Confident {
+		cnt, err := db.WriteToZhamJSON(cfg.Files.Zhams, res[0].SongID)
+		if err != nil {
+			return nil, err
+		}
+		update.Type = "match"
+		update.Matched = true
+		update.ZhamCount = cnt
+	}
+	if update.Matched || final {
+		// the session ends here
+		telemetry.query("live", peaks, fingerprints, res)
+	}
+
+	return update, nil
+}
+
+// failLiveSession reports err to the client in the JSON error envelope, which
+// also logs server side failures, and closes the session with code.
+func failLiveSession(conn *ws.Conn, code int, err error) error {
+	if err := conn.WriteJSON(liveError{Type: "error", Error: errorBodyFor(err)}); err != nil {
+		return err
+	}
+	return conn.Close(code, "")
+}
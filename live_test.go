@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"zham-app/config"
+	"zham-app/models"
+	"zham-app/ws"
+)
+
+// testSong is a deterministic stand-in for music: a few random tones every
+// quarter second over a little noise.
+func testSong(rate int, seconds float64) []float64 {
+	rng := rand.New(rand.NewSource(7))
+	samples := make([]float64, int(seconds*float64(rate)))
+	var freqs [3]float64
+	for i := range samples {
+		if i%(rate/4) == 0 {
+			for j := range freqs {
+				freqs[j] = 300 + rng.Float64()*4700
+			}
+		}
+		t := float64(i) / float64(rate)
+		v := 0.02 * (rng.Float64()*2 - 1)
+		for _, f := range freqs {
+			v += 0.25 * math.Sin(2*math.Pi*f*t)
+		}
+		samples[i] = v
+	}
+	return samples
+}
+
+// wsClient is the client end of a WebSocket, enough to drive a live session.
+type wsClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialLive(t *testing.T, url string) *wsClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	io.WriteString(conn, "GET /zham/live HTTP/1.1\r\nHost: zham\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake status %d", resp.StatusCode)
+	}
+	return &wsClient{conn: conn, br: br}
+}
+
+func (c *wsClient) write(opcode int, payload []byte) error {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | byte(opcode)}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xFFFF:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsClient) read(t *testing.T) (int, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.br, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.br, payload); err != nil {
+		t.Fatal(err)
+	}
+	return int(header[0] & 0x0F), payload
+}
+
+func TestLiveSessionMatches(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config.Default()
+	cfg.Store.Path = filepath.Join(dir, "zhamdb")
+	cfg.Files.Songs = filepath.Join(dir, "songs.json")
+	cfg.Files.Zhams = filepath.Join(dir, "zham.json")
+	if err := os.WriteFile(cfg.Files.Zhams, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, songs, err := openStores(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	rate := cfg.Fingerprint.SampleRate
+	song := testSong(rate, 20)
+	fingerprints, _, err := fingerprintSamples(cfg, song, "song1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storeSong(cfg, store, songs, models.Song{ID: "song1", Title: "Test Tones"}, fingerprints, false); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(liveQuery(cfg, store, songs))
+	defer srv.Close()
+	client := dialLive(t, srv.Listener.Addr().String())
+
+	if err := client.write(ws.OpText, []byte(fmt.Sprintf(`{"SampleRate": %d}`, rate))); err != nil {
+		t.Fatal(err)
+	}
+	var ready liveReady
+	if _, data := client.read(t); json.Unmarshal(data, &ready) != nil || ready.Type != "ready" {
+		t.Fatalf("first reply %q, want ready", data)
+	}
+
+	// 8 seconds from 5 seconds in, as s16le in quarter second messages
+	go func() {
+		clip := song[5*rate : 13*rate]
+		for len(clip) > 0 {
+			n := min(rate/4, len(clip))
+			pcm := make([]byte, 0, 2*n)
+			for _, v := range clip[:n] {
+				pcm = binary.LittleEndian.AppendUint16(pcm, uint16(int16(v*32767)))
+			}
+			if client.write(ws.OpBinary, pcm) != nil {
+				return
+			}
+			clip = clip[n:]
+		}
+		end, _ := json.Marshal(liveControl{Type: "end"})
+		client.write(ws.OpText, end)
+	}()
+
+	for {
+		opcode, data := client.read(t)
+		if opcode == ws.OpClose {
+			t.Fatalf("session closed with %q before a match", data)
+		}
+		var update liveUpdate
+		if err := json.Unmarshal(data, &update); err != nil {
+			t.Fatalf("bad update %q: %v", data, err)
+		}
+		if update.Type == "candidates" {
+			continue
+		}
+
+		if update.Type != "match" || !update.Matched || len(update.Matches) == 0 {
+			t.Fatalf("session ended with %s", data)
+		}
+		top := update.Matches[0]
+		if top.SongID != "song1" || top.Song == nil || top.Song.Title != "Test Tones" {
+			t.Errorf("matched %+v", top)
+		}
+		if math.Abs(top.OffsetSec-5) > 0.1 {
+			t.Errorf("matched at %.2fs, want 5s", top.OffsetSec)
+		}
+		if update.ZhamCount != 1 {
+			t.Errorf("zham count %d, want 1", update.ZhamCount)
+		}
+		break
+	}
+
+	opcode, data := client.read(t)
+	if opcode != ws.OpClose || binary.BigEndian.Uint16(data) != ws.CloseNormal {
+		t.Errorf("after the match got %#x %q, want a normal close", opcode, data)
+	}
+}
@@ -2,12 +2,22 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"mime"
 	"net/http"
+	"os"
 	"runtime"
+	"strconv"
+	"strings"
+	"time"
 
+	"zham-app/config"
 	"zham-app/db"
+	"zham-app/models"
 	"zham-app/wav"
 	"zham-app/zham"
 
@@ -15,17 +25,82 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		cmd, ok := commands[os.Args[1]]
+		if !ok {
+			usage()
+			os.Exit(2)
+		}
+		if err := cmd(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	fs := flag.NewFlagSet("zham", flag.ExitOnError)
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintln(os.Stderr, "\nserver flags:")
+		fs.PrintDefaults()
+	}
+	loader := config.NewLoader(fs)
+	fs.Parse(os.Args[1:])
+
+	cfg, err := loader.Load()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	fmt.Println("Zham!")
 
-	router := mux.NewRouter()
+	backend, err := db.Open(cfg.Store)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg.Fingerprint, err = zham.CheckProfile(backend, cfg.Fingerprint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Fingerprint profile", cfg.Fingerprint.ID())
+	if cfg.Fingerprint.Resampler != zham.ResamplerSinc {
+		log.Printf("The store resamples with ffmpeg: audio not at %d Hz starts an ffmpeg process per upload, query and live session", cfg.Fingerprint.SampleRate)
+	}
 
-	router.HandleFunc("/zham", searchForSongMatch()).Methods("POST", "OPTIONS")
-	router.HandleFunc("/zham", insertSong()).Methods("PUT", "OPTIONS")
-	router.HandleFunc("/zham/{songId}", getSongZhams()).Methods("GET", "OPTIONS")
+	startTime := time.Now()
+	store, err := db.NewIndex(backend)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+	fmt.Printf("Loaded index in %v: %+v\n", time.Since(startTime), store.Stats())
+
+	songs, err := db.OpenSongStore(cfg.Files.Songs)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	telemetry.watchIndex(store)
+
+	router := mux.NewRouter()
+	router.Use(telemetry.instrument)
+
+	router.HandleFunc("/zham", searchForSongMatch(cfg, store, songs)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/zham", insertSong(cfg, store, songs)).Methods("PUT", "OPTIONS")
+	router.HandleFunc("/zham/batch", ingestBatchHandler(cfg, store, songs)).Methods("POST", "OPTIONS")
+	router.HandleFunc("/zham/live", liveQuery(cfg, store, songs)).Methods("GET")
+	router.HandleFunc("/zham/{songId}", getSongZhams(cfg, songs)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/zham/{songId}", deleteSong(cfg, store, songs)).Methods("DELETE", "OPTIONS")
+	router.HandleFunc("/stats/index", getIndexStats(store)).Methods("GET", "OPTIONS")
+	router.HandleFunc("/config", getConfig(cfg)).Methods("GET", "OPTIONS")
+	router.Handle("/metrics", telemetry.registry.Handler()).Methods("GET")
+	if cfg.Server.Debug {
+		router.HandleFunc("/debug/spectrogram", debugSpectrogramFile(cfg, store)).Methods("GET", "OPTIONS")
+		router.HandleFunc("/debug/spectrogram", debugSpectrogramQuery(cfg, store)).Methods("POST", "OPTIONS")
+	}
 
 	enhancedRouter := enableCORS(jsonContentTypeMiddleware(router))
 
-	log.Fatal(http.ListenAndServe(":3030", enhancedRouter))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", cfg.Server.Port), enhancedRouter))
 }
 
 func enableCORS(next http.Handler) http.Handler {
@@ -50,22 +125,30 @@ func jsonContentTypeMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// JsonBody is the application/json form of a query: mono samples in [-1, 1]
+// at SampleRate.
 type JsonBody struct {
 	AudioSample []float64 `json:"audioSample"`
 	SampleRate  int       `json:"sampleRate"`
 	SongId      string    `json:"SongId"`
-	// audioDuration float64
 }
 
-func getSongZhams() http.HandlerFunc {
+func getSongZhams(cfg *config.Config, songs *db.SongStore) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
 		songId := vars["songId"]
 
 		res := 0
-		cnt, err := db.ReadNumZham("zham.json", songId)
-		if err != nil {
-			log.Fatal(err)
+		cnt, err := db.ReadNumZham(cfg.Files.Zhams, songId)
+		if errors.Is(err, db.ErrNotFound) {
+			// catalogued songs that were never matched have no counter yet
+			if _, ok := songs.Get(songId); !ok {
+				writeError(w, err)
+				return
+			}
+		} else if err != nil {
+			writeError(w, err)
+			return
 		} else {
 			res = cnt
 		}
@@ -75,135 +158,270 @@ func getSongZhams() http.HandlerFunc {
 	}
 }
 
-func insertSong() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// startTime := time.Now()
+// songFromForm builds the catalogue entry of an upload. Duration defaults to
+// the length of the decoded audio when the form doesn't carry one.
+func songFromForm(r *http.Request, songId string, numSamples int, sampleRate int) models.Song {
+	song := models.Song{
+		ID:          songId,
+		Title:       r.FormValue("Title"),
+		Artist:      r.FormValue("Artist"),
+		Album:       r.FormValue("Album"),
+		SourceURL:   r.FormValue("SourceUrl"),
+		DurationSec: float64(numSamples) / float64(sampleRate),
+	}
 
-		resampleRate := 48000
+	if duration, err := strconv.ParseFloat(r.FormValue("Duration"), 64); err == nil && duration > 0 {
+		song.DurationSec = duration
+	}
 
-		r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			log.Fatal(err)
+	return song
+}
+
+func insertSong(cfg *config.Config, store db.Store, songs *db.SongStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, cfg.Server.MaxUploadBytes)
+		if err := r.ParseMultipartForm(cfg.Server.MaxUploadBytes); err != nil {
+			writeError(w, badRequest(err))
+			return
 		}
 
 		songId := r.FormValue("SongId")
-		res, err := wav.ConverterToWAV(r, resampleRate)
-		if err != nil {
-			log.Fatal(err)
+		if songId == "" {
+			writeError(w, badRequest(errors.New("missing SongId")))
+			return
 		}
 
-		// json.NewEncoder(w).Encode(res)
+		replace := r.FormValue("Replace") == "true" || r.URL.Query().Get("replace") == "true"
+		if err := checkReplace(songs, songId, replace); err != nil {
+			writeError(w, err)
+			return
+		}
 
-		spectrogram, timeArr, err := zham.Spectrogram(res, resampleRate)
+		res, rate, err := wav.ConverterToWAV(r)
 		if err != nil {
-			log.Fatal(err)
+			writeError(w, err)
+			return
+		}
+		res, err = cfg.Fingerprint.Resample(res, rate)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
 
-		// peaks := zham.ExtractPeaks(spectrogram, timeArr, 1.0)
-		peaks := zham.GetPeaks(spectrogram, timeArr, 11, 5, 1.0)
-
-		fingerprints, _ := zham.Fingerprint(peaks, songId, 5)
-		// fmt.Println("fp_len", len(fingerprints))
-		if err := db.WriteToJSON("db.json", fingerprints); err != nil {
-			log.Fatal(err)
+		fingerprints, _, err := fingerprintSamples(cfg, res, songId)
+		if err != nil {
+			writeError(w, err)
+			return
 		}
 
-		// fmt.Println("time taken to save song: ", time.Since(startTime))
+		if err := storeSong(cfg, store, songs, songFromForm(r, songId, len(res), cfg.Fingerprint.SampleRate), fingerprints, replace); err != nil {
+			writeError(w, err)
+			return
+		}
 
 		json.NewEncoder(w).Encode("Success!")
 	}
 }
 
-func printMemUsage() {
-	var m runtime.MemStats
-	runtime.ReadMemStats(&m)
+// deleteSong purges a song's couples, catalogue entry and zham counter. It
+// succeeds for unknown IDs too, so retrying a delete is harmless.
+func deleteSong(cfg *config.Config, store db.Store, songs *db.SongStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		songId := vars["songId"]
+
+		if err := removeSong(cfg, store, songs, songId); err != nil {
+			writeError(w, err)
+			return
+		}
 
-	fmt.Printf("Alloc: %.2f MB, TotalAlloc: %.2f MB, Sys: %.2f MB, NumGC: %d\n",
-		float64(m.Alloc)/1024/1024,
-		float64(m.TotalAlloc)/1024/1024,
-		float64(m.Sys)/1024/1024,
-		m.NumGC,
-	)
+		json.NewEncoder(w).Encode("Deleted!")
+	}
 }
 
-func searchForSongMatch() http.HandlerFunc {
+func getIndexStats(index *db.Index) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// startTime := time.Now()
-
-		fmt.Println("Initial memory usage")
-		printMemUsage()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
 
-		resampleRate := 48000
+		type ResBody struct {
+			Index     db.IndexStats
+			HeapAlloc uint64
+			HeapSys   uint64
+		}
 
-		// r.Body = http.MaxBytesReader(w, r.Body, int64(50*1024*1024))
+		json.NewEncoder(w).Encode(ResBody{Index: index.Stats(), HeapAlloc: m.HeapAlloc, HeapSys: m.HeapSys})
+	}
+}
 
-		// var body JsonBody
-		// decoder := json.NewDecoder(r.Body)
-		// err := decoder.Decode(&body)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// 	// http.Error(w, "Invalid JSON body", http.StatusBadRequest)
-		// }
+// getConfig reports the settings the server is running with.
+func getConfig(cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(cfg)
+	}
+}
 
-		// spectrogram, timeArr, err := zham.Spectrogram(body.AudioSample, body.SampleRate)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// 	// fmt.Errorf("failed to extract spectrogram, %s", err)
-		// 	// return
-		// }
+// querySamples reads the query audio of a POST /zham request as mono samples
+// at the profile's sample rate. The body is picked by Content-Type:
+//
+//   - multipart/form-data with an "audio" file, as ingest takes
+//   - application/json holding a JsonBody
+//   - application/octet-stream of raw PCM, described by the rate, channels
+//     (default 1) and format (default s16le) query parameters
+//
+// The song ID is only carried by multipart forms.
+func querySamples(cfg *config.Config, w http.ResponseWriter, r *http.Request) ([]float64, string, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, cfg.Server.MaxUploadBytes)
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, "", &apiError{status: http.StatusUnsupportedMediaType, err: fmt.Errorf("missing or invalid Content-Type: %v", err)}
+	}
 
-		r.Body = http.MaxBytesReader(w, r.Body, 10<<20)
-		if err := r.ParseMultipartForm(10 << 20); err != nil {
-			log.Fatal(err)
+	switch mediaType {
+	case "multipart/form-data":
+		if err := r.ParseMultipartForm(cfg.Server.MaxUploadBytes); err != nil {
+			return nil, "", badRequest(err)
 		}
-
-		songId := r.FormValue("SongId")
-		samples, err := wav.ConverterToWAV(r, resampleRate)
+		samples, rate, err := wav.ConverterToWAV(r)
 		if err != nil {
-			log.Fatal(err)
+			return nil, "", err
+		}
+		samples, err = cfg.Fingerprint.Resample(samples, rate)
+		return samples, r.FormValue("SongId"), err
+
+	case "application/json":
+		var body JsonBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, "", err
+			}
+			return nil, "", badRequest(fmt.Errorf("invalid JSON body: %v", err))
+		}
+		if len(body.AudioSample) == 0 {
+			return nil, "", badRequest(errors.New("audioSample is empty"))
+		}
+		format := wav.RawFormat{SampleRate: body.SampleRate, Channels: 1, Encoding: "f64le"}
+		if err := format.Validate(); err != nil {
+			return nil, "", err
+		}
+		samples, err := cfg.Fingerprint.Resample(body.AudioSample, body.SampleRate)
+		return samples, body.SongId, err
+
+	case "application/octet-stream":
+		query := r.URL.Query()
+		format := wav.RawFormat{Channels: 1, Encoding: "s16le"}
+		if v := query.Get("format"); v != "" {
+			format.Encoding = v
+		}
+		for name, ptr := range map[string]*int{"rate": &format.SampleRate, "channels": &format.Channels} {
+			if v := query.Get(name); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					return nil, "", badRequest(fmt.Errorf("invalid %s %q", name, v))
+				}
+				*ptr = n
+			}
+		}
+		if format.SampleRate == 0 {
+			return nil, "", badRequest(errors.New("raw PCM needs a rate query parameter"))
+		}
+		if err := format.Validate(); err != nil {
+			return nil, "", err
 		}
 
-		spectrogram, timeArr, err := zham.Spectrogram(samples, resampleRate)
+		data, err := io.ReadAll(r.Body)
 		if err != nil {
-			log.Fatal(err)
-			// fmt.Errorf("failed to extract spectrogram, %s", err)
-			// return
+			return nil, "", err
 		}
+		if len(data) < format.FrameSize() {
+			return nil, "", badRequest(errors.New("body holds no PCM frame"))
+		}
+		mono, err := format.Mono(data)
+		if err != nil {
+			return nil, "", err
+		}
+		samples, err := cfg.Fingerprint.Resample(mono, format.SampleRate)
+		return samples, "", err
 
-		peaks := zham.GetPeaks(spectrogram, timeArr, 11, 5, 1.0)
-
-		fingerprints, numTargetZones := zham.Fingerprint(peaks, songId, 5)
+	default:
+		return nil, "", &apiError{
+			status: http.StatusUnsupportedMediaType,
+			err:    fmt.Errorf("unsupported Content-Type %q, send multipart/form-data, application/json or application/octet-stream", mediaType),
+		}
+	}
+}
 
-		// res, offsets, err := zham.FindMatches(fingerprints, 5, numTargetZones)
-		res, err := zham.FindMatches(fingerprints, 5, numTargetZones)
+func searchForSongMatch(cfg *config.Config, store db.Store, songs *db.SongStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		debug, err := debugRequested(cfg, r)
 		if err != nil {
-			log.Fatal(err)
+			writeError(w, err)
+			return
 		}
 
-		// fmt.Println("full time taken to search song: ", time.Since(startTime))
+		start := time.Now()
+		samples, songId, err := querySamples(cfg, w, r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		telemetry.stage(stageDecode, time.Since(start))
 
-		// type ResBody struct {
-		// 	Results []string
-		// 	Peaks   []models.Peak
-		// 	Offsets []zham.ColabBody
-		// }
+		var timings zham.PeakTimings
+		peaks, err := cfg.Fingerprint.TimedPeaks(samples, &timings)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		telemetry.stage(stageSpectrogram, timings.Spectrogram)
+		telemetry.stage(stagePeaks, timings.Peaks)
 
-		// Res := ResBody{Results: res, Peaks: peaks, Offsets: offsets}
+		start = time.Now()
+		fingerprints, numTargetZones, err := fingerprintPeaks(cfg, peaks, songId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		telemetry.stage(stageFingerprint, time.Since(start))
 
-		cnt, err := db.WriteToZhamJSON("zham.json", res[0])
+		res, err := findMatches(cfg, store, fingerprints, numTargetZones)
 		if err != nil {
-			log.Fatal(err)
+			writeError(w, err)
+			return
+		}
+		telemetry.query("post", len(peaks), fingerprints, res)
+
+		ids := make([]string, len(res))
+		for i, match := range res {
+			ids[i] = match.SongID
+		}
+
+		// only a confident top candidate counts as a zham, and debug queries
+		// are analysis rather than listeners
+		matched := len(res) > 0 && res[0].Confident
+		cnt := 0
+		if matched && !debug {
+			cnt, err = db.WriteToZhamJSON(cfg.Files.Zhams, res[0].SongID)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
 		}
 
 		type ResBody struct {
+			Matched   bool
+			Matches   []songMatch
 			Results   []string
 			ZhamCount int
+			Debug     *queryDebug `json:",omitempty"`
 		}
 
-		Res := ResBody{Results: res, ZhamCount: cnt}
-
-		fmt.Println("Final memory usage")
-		printMemUsage()
+		Res := ResBody{Matched: matched, Matches: withSongs(songs, res), Results: ids, ZhamCount: cnt}
+		if debug {
+			Res.Debug = newQueryDebug(peaks, fingerprints, numTargetZones, res)
+		}
 
 		json.NewEncoder(w).Encode(Res)
 	}
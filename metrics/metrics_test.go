@@ -0,0 +1,90 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const golden = `# HELP zham_requests_total Requests served.
+# TYPE zham_requests_total counter
+zham_requests_total{route="/zham/\"quoted\"",status="404"} 1
+zham_requests_total{route="/zham",status="200"} 3
+zham_requests_total{route="C:\\songs\nnext",status="500"} 0.5
+# HELP zham_index_songs Songs in the index,\nper backend \\ store.
+# TYPE zham_index_songs gauge
+zham_index_songs 42
+# HELP zham_request_seconds Request latency.
+# TYPE zham_request_seconds histogram
+zham_request_seconds_bucket{route="/zham",le="0.1"} 1
+zham_request_seconds_bucket{route="/zham",le="0.5"} 3
+zham_request_seconds_bucket{route="/zham",le="1"} 3
+zham_request_seconds_bucket{route="/zham",le="+Inf"} 4
+zham_request_seconds_sum{route="/zham"} 3.75
+zham_request_seconds_count{route="/zham"} 4
+zham_request_seconds_bucket{route="/zham/live",le="0.1"} 0
+zham_request_seconds_bucket{route="/zham/live",le="0.5"} 0
+zham_request_seconds_bucket{route="/zham/live",le="1"} 0
+zham_request_seconds_bucket{route="/zham/live",le="+Inf"} 1
+zham_request_seconds_sum{route="/zham/live"} 30
+zham_request_seconds_count{route="/zham/live"} 1
+# HELP zham_empty_total Never incremented.
+# TYPE zham_empty_total counter
+`
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("zham_requests_total", "Requests served.", "route", "status")
+	songs := r.NewGauge("zham_index_songs", "Songs in the index,\nper backend \\ store.")
+	latency := r.NewHistogram("zham_request_seconds", "Request latency.", []float64{0.1, 0.5, 1}, "route")
+	r.NewCounter("zham_empty_total", "Never incremented.")
+
+	requests.Inc("/zham", "200")
+	requests.Add(2, "/zham", "200")
+	requests.Inc(`/zham/"quoted"`, "404")
+	requests.Add(0.5, "C:\\songs\nnext", "500")
+
+	collected := 0
+	r.OnCollect(func() {
+		collected++
+		songs.Set(42)
+	})
+	songs.Set(7)
+
+	// 0.5 falls into the bucket it bounds
+	for _, v := range []float64{0.05, 0.2, 0.5, 3} {
+		latency.Observe(v, "/zham")
+	}
+	latency.Observe(30, "/zham/live")
+
+	var b strings.Builder
+	n, err := r.WriteTo(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := b.String(); got != golden {
+		t.Errorf("exposition differs\n got:\n%s\nwant:\n%s", got, golden)
+	}
+	if n != int64(len(golden)) {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, len(golden))
+	}
+	if collected != 1 {
+		t.Errorf("collect hooks ran %d times, want once per scrape", collected)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewGauge("zham_up", "Whether the server is up.").Set(1)
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Errorf("Content-Type = %q, want %q", ct, ContentType)
+	}
+	want := "# HELP zham_up Whether the server is up.\n# TYPE zham_up gauge\nzham_up 1\n"
+	if rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
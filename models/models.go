@@ -9,3 +9,12 @@ type Peak struct {
 	Time float64
 	Freq int32
 }
+
+type Song struct {
+	ID          string
+	Title       string
+	Artist      string
+	Album       string
+	DurationSec float64
+	SourceURL   string
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"zham-app/config"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/zham"
+)
+
+// openStores opens the configured store and song catalogue.
+func openStores(cfg *config.Config) (db.Store, *db.SongStore, error) {
+	store, err := db.Open(cfg.Store)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cfg.Fingerprint, err = zham.CheckProfile(store, cfg.Fingerprint)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+
+	songs, err := db.OpenSongStore(cfg.Files.Songs)
+	if err != nil {
+		store.Close()
+		return nil, nil, err
+	}
+	return store, songs, nil
+}
+
+// fingerprintSamples runs the peak picking and hashing shared by ingest and
+// search on samples at the profile's sample rate. It also returns the number
+// of target zones FindMatches needs.
+func fingerprintSamples(cfg *config.Config, samples []float64, songId string) (map[uint32][]models.Couple, int, error) {
+	peaks, err := cfg.Fingerprint.Peaks(samples)
+	if err != nil {
+		return nil, 0, err
+	}
+	return fingerprintPeaks(cfg, peaks, songId)
+}
+
+// fingerprintPeaks is the hashing half of fingerprintSamples.
+func fingerprintPeaks(cfg *config.Config, peaks []models.Peak, songId string) (map[uint32][]models.Couple, int, error) {
+	fingerprints, numTargetZones := cfg.Fingerprint.Fingerprint(peaks, songId)
+	if len(fingerprints) == 0 {
+		return nil, 0, zham.ErrNoFingerprints
+	}
+	return fingerprints, numTargetZones, nil
+}
+
+// findMatches looks the query fingerprints up with the configured matcher,
+// timing the lookup and scoring stages.
+func findMatches(cfg *config.Config, store db.Store, fingerprints map[uint32][]models.Couple, numTargetZones int) ([]zham.Match, error) {
+	timer := &lookupTimer{Store: store}
+	start := time.Now()
+	res, err := zham.FindMatches(timer, fingerprints, cfg.Fingerprint.TargetZoneSize, numTargetZones, cfg.Match)
+	if err != nil {
+		return nil, err
+	}
+
+	telemetry.stage(stageLookup, timer.elapsed)
+	telemetry.stage(stageScoring, time.Since(start)-timer.elapsed)
+	return res, nil
+}
+
+// songMatch is a candidate of a query with its catalogue entry, nil for a song
+// with couples but no entry.
+type songMatch struct {
+	zham.Match
+	Song *models.Song
+}
+
+// withSongs looks up the catalogue entries of matches.
+func withSongs(songs *db.SongStore, matches []zham.Match) []songMatch {
+	res := make([]songMatch, len(matches))
+	for i, match := range matches {
+		res[i].Match = match
+		if song, ok := songs.Get(match.SongID); ok {
+			res[i].Song = &song
+		}
+	}
+	return res
+}
+
+// checkReplace refuses to ingest a catalogued song again unless replace is
+// set, since that would duplicate all of its couples. Callers check before
+// fingerprinting to fail fast, storeSong and writeBatch check again under the
+// song's lock.
+func checkReplace(songs *db.SongStore, songId string, replace bool) error {
+	if _, exists := songs.Get(songId); exists && !replace {
+		return &apiError{
+			status: http.StatusConflict,
+			err:    fmt.Errorf("song %s already exists, set Replace=true to re-ingest it", songId),
+		}
+	}
+	return nil
+}
+
+// storeSong writes the fingerprints and catalogue entry of song, unless it is
+// catalogued already and replace isn't set. With replace set the song's old
+// couples and zham count are dropped first, and its catalogue entry too if
+// the new couples can't be stored.
+func storeSong(cfg *config.Config, store db.Store, songs *db.SongStore, song models.Song, fingerprints map[uint32][]models.Couple, replace bool) error {
+	unlock := ingestLocks.lock(song.ID)
+	defer unlock()
+
+	if err := checkReplace(songs, song.ID, replace); err != nil {
+		return err
+	}
+	if replace {
+		if err := purgeSong(cfg, store, song.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := store.Put(fingerprints); err != nil {
+		if replace {
+			return dropPurged(songs, err, song.ID)
+		}
+		return err
+	}
+
+	return songs.Put(song)
+}
+
+// dropPurged removes the catalogue entries of songs purged for a replacement
+// whose couples failed to store with err, so none is left without couples.
+func dropPurged(songs *db.SongStore, err error, songIds ...string) error {
+	if delErr := songs.Delete(songIds...); delErr != nil {
+		return errors.Join(err, delErr)
+	}
+	return err
+}
+
+// removeSong drops the couples, catalogue entry and zham count of a song,
+// under its ingest lock so an upload of the same ID can't interleave.
+func removeSong(cfg *config.Config, store db.Store, songs *db.SongStore, songId string) error {
+	unlock := ingestLocks.lock(songId)
+	defer unlock()
+
+	if err := store.DeleteSong(songId); err != nil {
+		return err
+	}
+	if err := songs.Delete(songId); err != nil {
+		return err
+	}
+	return forgetZhams(cfg, songId)
+}
+
+// purgeSong drops the couples and zham count of a song, leaving its catalogue
+// entry alone.
+func purgeSong(cfg *config.Config, store db.Store, songId string) error {
+	if err := store.DeleteSong(songId); err != nil {
+		return err
+	}
+	return forgetZhams(cfg, songId)
+}
+
+// forgetZhams drops the zham count of a song. A missing zham file holds no
+// count to drop.
+func forgetZhams(cfg *config.Config, songId string) error {
+	if err := db.DeleteFromZhamJSON(cfg.Files.Zhams, songId); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ingestLocks serializes ingesting each song, so concurrent uploads of one ID
+// can't both pass checkReplace and store its couples twice.
+var ingestLocks = songLocks{held: map[string]*songLock{}}
+
+type songLocks struct {
+	mu   sync.Mutex
+	held map[string]*songLock
+}
+
+type songLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks the given song IDs, in sorted order so that callers locking
+// overlapping sets can't deadlock, and returns the function unlocking them.
+func (l *songLocks) lock(ids ...string) func() {
+	ids = append([]string(nil), ids...)
+	sort.Strings(ids)
+
+	locks := make([]*songLock, len(ids))
+	for i, id := range ids {
+		l.mu.Lock()
+		lock, ok := l.held[id]
+		if !ok {
+			lock = &songLock{}
+			l.held[id] = lock
+		}
+		lock.waiters++
+		l.mu.Unlock()
+
+		lock.Lock()
+		locks[i] = lock
+	}
+
+	return func() {
+		for i, lock := range locks {
+			lock.Unlock()
+
+			l.mu.Lock()
+			if lock.waiters--; lock.waiters == 0 {
+				delete(l.held, ids[i])
+			}
+			l.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package plot
+
+import (
+	"image"
+	"image/color"
+)
+
+const (
+	glyphWidth  = 3
+	glyphHeight = 5
+	// textScale is the size of a glyph pixel in image pixels.
+	textScale = 2
+)
+
+// glyphs is a 3x5 bitmap font covering what the axis labels need. Each row
+// holds three bits, the most significant one leftmost.
+var glyphs = map[rune][glyphHeight]uint8{
+	'0': {0b111, 0b101, 0b101, 0b101, 0b111},
+	'1': {0b010, 0b110, 0b010, 0b010, 0b111},
+	'2': {0b111, 0b001, 0b111, 0b100, 0b111},
+	'3': {0b111, 0b001, 0b111, 0b001, 0b111},
+	'4': {0b101, 0b101, 0b111, 0b001, 0b001},
+	'5': {0b111, 0b100, 0b111, 0b001, 0b111},
+	'6': {0b111, 0b100, 0b111, 0b101, 0b111},
+	'7': {0b111, 0b001, 0b010, 0b010, 0b010},
+	'8': {0b111, 0b101, 0b111, 0b101, 0b111},
+	'9': {0b111, 0b101, 0b111, 0b001, 0b111},
+	'k': {0b100, 0b101, 0b110, 0b101, 0b101},
+	's': {0b000, 0b111, 0b100, 0b011, 0b111},
+}
+
+// textWidth is the width drawText takes for s, including the gaps between
+// glyphs.
+func textWidth(s string) int {
+	n := len([]rune(s))
+	if n == 0 {
+		return 0
+	}
+	return (n*(glyphWidth+1) - 1) * textScale
+}
+
+// drawText draws s with its top left corner at (x, y). Runes without a glyph
+// are left blank.
+func drawText(img *image.RGBA, x, y int, s string, c color.RGBA) {
+	for _, r := range s {
+		glyph := glyphs[r]
+		for row, bits := range glyph {
+			for col := 0; col < glyphWidth; col++ {
+				if bits&(1<<(glyphWidth-1-col)) != 0 {
+					px, py := x+col*textScale, y+row*textScale
+					fill(img, image.Rect(px, py, px+textScale, py+textScale), c)
+				}
+			}
+		}
+		x += (glyphWidth + 1) * textScale
+	}
+}
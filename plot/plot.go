@@ -0,0 +1,241 @@
+// Package plot renders spectrograms as PNG-ready images for inspecting what
+// the fingerprinting pipeline saw, using only the standard image packages.
+package plot
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"zham-app/models"
+	"zham-app/zham"
+)
+
+const (
+	// DynamicRange is how many dB below the loudest pixel the colour map
+	// reaches black.
+	DynamicRange = 80.0
+
+	marginLeft   = 36
+	marginRight  = 10
+	marginTop    = 10
+	marginBottom = 24
+)
+
+var (
+	background = color.RGBA{24, 24, 24, 255}
+	axisColor  = color.RGBA{200, 200, 200, 255}
+	peakColor  = color.RGBA{255, 255, 255, 255}
+	pairColor  = color.RGBA{0, 230, 255, 255}
+	anchorMark = color.RGBA{80, 255, 80, 255}
+
+	// colour map stops from quiet to loud, after matplotlib's inferno
+	stops = []color.RGBA{
+		{0, 0, 4, 255},
+		{87, 16, 110, 255},
+		{188, 55, 84, 255},
+		{249, 142, 9, 255},
+		{252, 255, 164, 255},
+	}
+)
+
+// Pair is a hash drawn as a line from its anchor to its target peak.
+type Pair struct {
+	Anchor models.Peak
+	Target models.Peak
+}
+
+// Spectrogram gathers frames into a fixed grid of pixels, keeping the loudest
+// bin falling into each, so audio of any length is drawn at a bounded size
+// without holding its frames.
+type Spectrogram struct {
+	width, height int
+	duration      float64 // seconds across the plot
+	maxHz         float64 // frequency at the top of the plot
+	bins          int     // magnitudes per frame
+	cells         []float64
+}
+
+// NewSpectrogram returns a plot of width by height pixels spanning duration
+// seconds and frames of bins magnitudes reaching up to maxHz.
+func NewSpectrogram(duration float64, maxHz float64, bins int, width int, height int) *Spectrogram {
+	cells := make([]float64, width*height)
+	for i := range cells {
+		cells[i] = math.Inf(-1)
+	}
+	return &Spectrogram{width: width, height: height, duration: duration, maxHz: maxHz, bins: bins, cells: cells}
+}
+
+// Add draws a frame into its column.
+func (s *Spectrogram) Add(frame zham.Frame) {
+	col := s.column(frame.Time)
+	for bin, mag := range frame.Magnitudes[:min(len(frame.Magnitudes), s.bins)] {
+		cell := &s.cells[s.row(bin)*s.width+col]
+		*cell = max(*cell, mag)
+	}
+}
+
+func (s *Spectrogram) column(t float64) int {
+	return min(max(int(t/s.duration*float64(s.width)), 0), s.width-1)
+}
+
+// row maps a frequency bin to its pixel row, counted from the top.
+func (s *Spectrogram) row(bin int) int {
+	return s.height - 1 - min(max(bin*s.height/s.bins, 0), s.height-1)
+}
+
+// Image renders the plot with axes, the constellation peaks as white dots
+// and pairs as lines from a green anchor to its target.
+func (s *Spectrogram) Image(peaks []models.Peak, pairs []Pair) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, marginLeft+s.width+marginRight, marginTop+s.height+marginBottom))
+	fill(img, img.Bounds(), background)
+
+	top := math.Inf(-1)
+	for _, db := range s.cells {
+		top = max(top, db)
+	}
+
+	for y := 0; y < s.height; y++ {
+		last := math.Inf(-1)
+		for x := 0; x < s.width; x++ {
+			db := s.cells[y*s.width+x]
+			// columns no frame fell into, when there are fewer frames than
+			// pixels, repeat the one before
+			if math.IsInf(db, -1) {
+				db = last
+			}
+			last = db
+			img.SetRGBA(marginLeft+x, marginTop+y, colorFor((db-top+DynamicRange)/DynamicRange))
+		}
+	}
+
+	s.drawAxes(img)
+
+	for _, pair := range pairs {
+		x0, y0 := s.point(pair.Anchor)
+		x1, y1 := s.point(pair.Target)
+		line(img, x0, y0, x1, y1, pairColor)
+	}
+	for _, peak := range peaks {
+		x, y := s.point(peak)
+		for _, d := range [][2]int{{0, 0}, {-1, 0}, {1, 0}, {0, -1}, {0, 1}} {
+			img.SetRGBA(x+d[0], y+d[1], peakColor)
+		}
+	}
+	for _, pair := range pairs {
+		x, y := s.point(pair.Anchor)
+		rect(img, image.Rect(x-2, y-2, x+3, y+3), anchorMark)
+	}
+
+	return img
+}
+
+// point is the pixel of a peak, whose Freq is a bin index.
+func (s *Spectrogram) point(p models.Peak) (int, int) {
+	return marginLeft + s.column(p.Time), marginTop + s.row(int(p.Freq))
+}
+
+func (s *Spectrogram) drawAxes(img *image.RGBA) {
+	plot := image.Rect(marginLeft, marginTop, marginLeft+s.width, marginTop+s.height)
+	rect(img, plot.Inset(-1), axisColor)
+
+	// frequency ticks every kHz, or every 2 kHz above 10 kHz
+	stepHz := 1000.0
+	if s.maxHz > 10000 {
+		stepHz = 2000
+	}
+	for hz := 0.0; hz <= s.maxHz; hz += stepHz {
+		y := marginTop + s.row(int(hz/s.maxHz*float64(s.bins)))
+		fill(img, image.Rect(marginLeft-5, y, marginLeft-1, y+1), axisColor)
+		label := fmt.Sprintf("%dk", int(hz/1000))
+		drawText(img, marginLeft-7-textWidth(label), y-glyphHeight*textScale/2, label, axisColor)
+	}
+
+	// at most ten time ticks, on whole seconds
+	step := 1
+	for _, candidate := range []int{1, 2, 5, 10, 15, 30, 60, 120, 300} {
+		step = candidate
+		if s.duration/float64(step) <= 10 {
+			break
+		}
+	}
+	for sec := 0; float64(sec) <= s.duration; sec += step {
+		x := marginLeft + s.column(float64(sec))
+		fill(img, image.Rect(x, plot.Max.Y, x+1, plot.Max.Y+4), axisColor)
+		label := fmt.Sprintf("%ds", sec)
+		drawText(img, x-textWidth(label)/2, plot.Max.Y+7, label, axisColor)
+	}
+}
+
+// colorFor maps v in [0, 1] onto the colour map, clamping outside it.
+func colorFor(v float64) color.RGBA {
+	if math.IsNaN(v) || v <= 0 {
+		return stops[0]
+	}
+	if v >= 1 {
+		return stops[len(stops)-1]
+	}
+
+	pos := v * float64(len(stops)-1)
+	i := int(pos)
+	frac := pos - float64(i)
+	a, b := stops[i], stops[i+1]
+	lerp := func(x, y uint8) uint8 {
+		return uint8(float64(x) + (float64(y)-float64(x))*frac)
+	}
+	return color.RGBA{lerp(a.R, b.R), lerp(a.G, b.G), lerp(a.B, b.B), 255}
+}
+
+func fill(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	r = r.Intersect(img.Bounds())
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.SetRGBA(x, y, c)
+		}
+	}
+}
+
+// rect draws the outline of r.
+func rect(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	fill(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+1), c)
+	fill(img, image.Rect(r.Min.X, r.Max.Y-1, r.Max.X, r.Max.Y), c)
+	fill(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X+1, r.Max.Y), c)
+	fill(img, image.Rect(r.Max.X-1, r.Min.Y, r.Max.X, r.Max.Y), c)
+}
+
+// line draws from (x0, y0) to (x1, y1) with Bresenham's algorithm.
+func line(img *image.RGBA, x0, y0, x1, y1 int, c color.RGBA) {
+	dx, dy := abs(x1-x0), -abs(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+
+	err := dx + dy
+	for {
+		img.SetRGBA(x0, y0, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
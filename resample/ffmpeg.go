@@ -0,0 +1,152 @@
+package resample
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// FFmpeg resamples through an ffmpeg process, the way every upload was
+// converted before the native decoder: ffmpeg's default resampler to toRate,
+// quantized to signed 16 bit. It reproduces the fingerprints of those stores,
+// which Sinc doesn't. The signal is piped through as it is written, so Write
+// returns whatever ffmpeg has produced by then.
+//
+// FFmpeg fails when ffmpeg does, after which it returns no more samples and
+// Err says why. Close stops the process of a resampler that isn't flushed.
+type FFmpeg struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr strings.Builder
+	done   chan struct{} // closed once stdout is drained
+
+	mu     sync.Mutex
+	output []float64
+	err    error
+}
+
+// NewFFmpeg starts ffmpeg converting from fromRate to toRate.
+func NewFFmpeg(fromRate, toRate int) (*FFmpeg, error) {
+	cmd := exec.Command("ffmpeg", "-nostdin", "-hide_banner", "-loglevel", "error",
+		"-f", "f64le", "-ar", fmt.Sprint(fromRate), "-ac", "1", "-i", "pipe:0",
+		"-f", "s16le", "-ar", fmt.Sprint(toRate), "-ac", "1", "pipe:1")
+
+	r := &FFmpeg{cmd: cmd, done: make(chan struct{})}
+	cmd.Stderr = &r.stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("resample: starting ffmpeg: %w", err)
+	}
+	r.stdin = stdin
+
+	go r.read(stdout)
+	return r, nil
+}
+
+// read collects the samples ffmpeg writes until it exits.
+func (r *FFmpeg) read(stdout io.Reader) {
+	defer close(r.done)
+
+	br := bufio.NewReader(stdout)
+	var frame [2]byte
+	for {
+		if _, err := io.ReadFull(br, frame[:]); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				r.fail(err)
+			}
+			return
+		}
+		sample := float64(int16(binary.LittleEndian.Uint16(frame[:]))) / 32768.0
+
+		r.mu.Lock()
+		r.output = append(r.output, sample)
+		r.mu.Unlock()
+	}
+}
+
+func (r *FFmpeg) fail(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// take returns the samples read so far, or none once r has failed.
+func (r *FFmpeg) take() []float64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return nil
+	}
+	output := r.output
+	r.output = nil
+	return output
+}
+
+func (r *FFmpeg) Write(input []float64) []float64 {
+	if r.Err() != nil {
+		return nil
+	}
+
+	buf := make([]byte, 8*len(input))
+	for i, sample := range input {
+		binary.LittleEndian.PutUint64(buf[8*i:], math.Float64bits(sample))
+	}
+	if _, err := r.stdin.Write(buf); err != nil {
+		r.fail(fmt.Errorf("resample: writing to ffmpeg: %w", err))
+	}
+	return r.take()
+}
+
+// Flush ends the input and returns the rest of ffmpeg's output once it has
+// exited.
+func (r *FFmpeg) Flush() []float64 {
+	r.stdin.Close()
+	<-r.done
+	if err := r.cmd.Wait(); err != nil {
+		r.fail(fmt.Errorf("resample: ffmpeg: %w: %s", err, strings.TrimSpace(r.stderr.String())))
+	}
+	return r.take()
+}
+
+// Err returns the error that stopped r, if any.
+func (r *FFmpeg) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+// Close kills ffmpeg unless Flush already waited for it.
+func (r *FFmpeg) Close() error {
+	if r.cmd.ProcessState != nil {
+		return nil
+	}
+	r.stdin.Close()
+	r.cmd.Process.Kill()
+	<-r.done
+	r.cmd.Wait()
+	return nil
+}
+
+// Err returns the error that stopped r, for resamplers that can fail like
+// FFmpeg, and nil for the others.
+func Err(r Resampler) error {
+	if f, ok := r.(interface{ Err() error }); ok {
+		return f.Err()
+	}
+	return nil
+}
@@ -0,0 +1,20 @@
+// Package resample converts mono signals between sample rates. Sinc is a
+// band-limited polyphase FIR resampler for arbitrary rational rate ratios and
+// FFmpeg pipes the signal through ffmpeg, as uploads were before it. Both
+// take the audio in chunks, so a stream never has to be held in full.
+package resample
+
+// Resampler converts a signal fed in chunks. Write returns the output samples
+// that can be computed so far, Flush the rest once the input has ended.
+// Writing a signal in any split and then flushing yields the same samples as
+// passing it to Run.
+type Resampler interface {
+	Write(input []float64) []float64
+	Flush() []float64
+}
+
+// Run resamples a whole signal with r, which can't be reused afterwards.
+func Run(r Resampler, input []float64) []float64 {
+	output := r.Write(input)
+	return append(output, r.Flush()...)
+}
@@ -0,0 +1,212 @@
+package resample
+
+import (
+	"math"
+	"sync"
+)
+
+const (
+	// Rolloff places the default cutoff just below the Nyquist frequency of
+	// the lower of the two rates.
+	Rolloff = 0.95
+
+	// zeroCrossings is how many zero crossings of the sinc are kept on each
+	// side of the kernel, which sets the width of the transition band.
+	zeroCrossings = 32
+	// kaiserBeta shapes the window for roughly 80 dB of stopband attenuation.
+	kaiserBeta = 8.0
+	// maxPhases bounds the filter bank. Rate ratios that would need more
+	// phases are replaced by the closest ratio that doesn't. That is off by
+	// less than 1/maxPhases of the ratio, and by less than a millionth
+	// between the common audio rates.
+	maxPhases = 4096
+)
+
+// Sinc is a polyphase windowed-sinc resampler. The output runs at up/down
+// times the input rate and output sample i is taken at input position
+// i*down/up, by convolving the input with a Kaiser-windowed sinc low-pass
+// whose taps for each of the up fractional positions are precomputed. The
+// kernel is centred, so the output isn't delayed against the input.
+type Sinc struct {
+	up, down int
+	half     int // taps on each side of the output position
+	bank     [][]float64
+
+	emitted  int
+	consumed int // input samples dropped from the front of buf
+	total    int
+	buf      []float64
+}
+
+type bankKey struct {
+	up, down int
+	fc       float64
+}
+
+// banks caches filter banks by rate ratio and cutoff, they are read only.
+var banks sync.Map
+
+// NewSinc returns a resampler from fromRate to toRate that removes everything
+// above cutoffHz. A cutoff of 0, or one too close to the lower rate's Nyquist
+// frequency to filter without aliasing, is replaced by Rolloff times that
+// Nyquist frequency.
+func NewSinc(fromRate, toRate int, cutoffHz float64) *Sinc {
+	up, down := ratio(toRate, fromRate)
+
+	nyquist := 0.5 * float64(min(fromRate, toRate))
+	if cutoffHz <= 0 || cutoffHz > Rolloff*nyquist {
+		cutoffHz = Rolloff * nyquist
+	}
+	// the kernel is laid out in input samples
+	fc := cutoffHz / float64(fromRate)
+
+	key := bankKey{up, down, fc}
+	bank, ok := banks.Load(key)
+	if !ok {
+		bank, _ = banks.LoadOrStore(key, newBank(up, fc))
+	}
+
+	b := bank.([][]float64)
+	return &Sinc{up: up, down: down, half: len(b[0]) / 2, bank: b}
+}
+
+// Resample converts a whole signal with NewSinc and the default cutoff.
+func Resample(input []float64, fromRate, toRate int) []float64 {
+	if fromRate == toRate {
+		return input
+	}
+	return Run(NewSinc(fromRate, toRate, 0), input)
+}
+
+// ratio reduces to/from. When that takes more than maxPhases phases it returns
+// the closest fraction that doesn't, found among the convergents and
+// semiconvergents of the continued fraction of to/from.
+func ratio(to, from int) (up, down int) {
+	a, b := to, from
+	for b != 0 {
+		a, b = b, a%b
+	}
+	up, down = to/a, from/a
+	if up <= maxPhases {
+		return up, down
+	}
+
+	p0, q0, p1, q1 := 0, 1, 1, 0
+	for a, b := to, from; b != 0; a, b = b, a%b {
+		k := a / b
+		p2, q2 := k*p1+p0, k*q1+q0
+		if p2 > maxPhases {
+			break
+		}
+		p0, q0, p1, q1 = p1, q1, p2, q2
+	}
+
+	// the largest semiconvergent that fits can be closer than p1/q1
+	k := (maxPhases - p0) / p1
+	p2, q2 := k*p1+p0, k*q1+q0
+	exact := float64(to) / float64(from)
+	if math.Abs(float64(p2)/float64(q2)-exact) < math.Abs(float64(p1)/float64(q1)-exact) {
+		return p2, q2
+	}
+	return p1, q1
+}
+
+// newBank computes the taps of each of the up phases. Phase p serves output
+// positions p/up past an input sample; its taps cover the half input samples
+// either side of that position. Each phase is normalised to unity gain at DC.
+func newBank(up int, fc float64) [][]float64 {
+	halfWidth := zeroCrossings / (2 * fc)
+	half := int(math.Ceil(halfWidth))
+	norm := besselI0(kaiserBeta)
+
+	bank := make([][]float64, up)
+	for p := range bank {
+		frac := float64(p) / float64(up)
+		taps := make([]float64, 2*half)
+		sum := 0.0
+		for j := range taps {
+			// distance from the output position to input sample j-half+1
+			t := frac - float64(j-half+1)
+			if math.Abs(t) < halfWidth {
+				x := 2 * fc * t
+				h := 2 * fc
+				if x != 0 {
+					h *= math.Sin(math.Pi*x) / (math.Pi * x)
+				}
+				r := t / halfWidth
+				taps[j] = h * besselI0(kaiserBeta*math.Sqrt(1-r*r)) / norm
+			}
+			sum += taps[j]
+		}
+		for j := range taps {
+			taps[j] /= sum
+		}
+		bank[p] = taps
+	}
+	return bank
+}
+
+// besselI0 is the zeroth order modified Bessel function of the first kind,
+// which the Kaiser window is built from.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; term > 1e-12*sum; k++ {
+		half := x / (2 * float64(k))
+		term *= half * half
+		sum += term
+	}
+	return sum
+}
+
+func (r *Sinc) Write(input []float64) []float64 {
+	r.buf = append(r.buf, input...)
+	r.total += len(input)
+
+	var output []float64
+	// an output needs the half input samples after its position
+	for ; r.emitted*r.down/r.up+r.half < r.total; r.emitted++ {
+		output = append(output, r.sample(r.emitted))
+	}
+
+	// keep the input from the next output's first tap on
+	if drop := r.emitted*r.down/r.up - r.half + 1 - r.consumed; drop > 0 {
+		drop = min(drop, len(r.buf))
+		r.buf = append(r.buf[:0], r.buf[drop:]...)
+		r.consumed += drop
+	}
+
+	return output
+}
+
+// Flush returns the outputs up to the end of the input, taking the signal to
+// be silent past it.
+func (r *Sinc) Flush() []float64 {
+	var output []float64
+	for ; r.emitted < r.total*r.up/r.down; r.emitted++ {
+		output = append(output, r.sample(r.emitted))
+	}
+	return output
+}
+
+func (r *Sinc) sample(i int) float64 {
+	pos := i * r.down
+	taps := r.bank[pos%r.up]
+	// buf index of the input sample under taps[0]; the signal is silent
+	// before the first and after the last sample
+	start := pos/r.up - r.half + 1 - r.consumed
+
+	sum := 0.0
+	if start >= 0 && start+len(taps) <= len(r.buf) {
+		for j, x := range r.buf[start : start+len(taps)] {
+			sum += x * taps[j]
+		}
+		return sum
+	}
+
+	for j, h := range taps {
+		if k := start + j; k >= 0 && k < len(r.buf) {
+			sum += r.buf[k] * h
+		}
+	}
+	return sum
+}
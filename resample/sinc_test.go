@@ -0,0 +1,122 @@
+package resample
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+func tone(freq float64, rate, n int) []float64 {
+	signal := make([]float64, n)
+	for i := range signal {
+		signal[i] = math.Sin(2 * math.Pi * freq * float64(i) / float64(rate))
+	}
+	return signal
+}
+
+// rms measures the middle half of signal, away from the edges where the
+// kernel runs into silence.
+func rms(signal []float64) float64 {
+	middle := signal[len(signal)/4 : 3*len(signal)/4]
+	sum := 0.0
+	for _, x := range middle {
+		sum += x * x
+	}
+	return math.Sqrt(sum / float64(len(middle)))
+}
+
+func TestSincChunksMatchRun(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	input := make([]float64, 20000)
+	for i := range input {
+		input[i] = rng.Float64()*2 - 1
+	}
+
+	for _, rates := range [][2]int{{44100, 48000}, {22050, 48000}, {96000, 48000}, {8000, 11025}} {
+		want := Run(NewSinc(rates[0], rates[1], 0), input)
+
+		for trial := 0; trial < 5; trial++ {
+			r := NewSinc(rates[0], rates[1], 0)
+			var got []float64
+			for rest := input; len(rest) > 0; {
+				n := min(rng.Intn(3000), len(rest))
+				got = append(got, r.Write(rest[:n])...)
+				rest = rest[n:]
+			}
+			got = append(got, r.Flush()...)
+
+			if len(got) != len(want) {
+				t.Fatalf("%d -> %d: chunked gave %d samples, Run %d", rates[0], rates[1], len(got), len(want))
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Fatalf("%d -> %d: sample %d is %v chunked, %v from Run", rates[0], rates[1], i, got[i], want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestSincOutputLength(t *testing.T) {
+	tests := []struct {
+		from, to, in, out int
+	}{
+		{44100, 48000, 44100, 48000},
+		{44100, 48000, 1000, 1088},
+		{22050, 48000, 22050, 48000},
+		{22050, 48000, 1001, 2179},
+		{96000, 48000, 96000, 48000},
+		{96000, 48000, 1001, 500},
+	}
+	for _, tt := range tests {
+		got := Resample(make([]float64, tt.in), tt.from, tt.to)
+		if len(got) != tt.out {
+			t.Errorf("%d samples %d -> %d: got %d samples, want %d", tt.in, tt.from, tt.to, len(got), tt.out)
+		}
+	}
+}
+
+func TestSincKeepsPassband(t *testing.T) {
+	for _, rates := range [][2]int{{44100, 48000}, {22050, 48000}, {96000, 48000}} {
+		input := tone(1000, rates[0], rates[0])
+		got := rms(Resample(input, rates[0], rates[1]))
+		if want := rms(input); math.Abs(got-want) > 0.01*want {
+			t.Errorf("%d -> %d: 1 kHz tone has rms %.4f, want %.4f", rates[0], rates[1], got, want)
+		}
+	}
+}
+
+func TestSincAttenuatesAboveNyquist(t *testing.T) {
+	// 30 kHz is above the 24 kHz Nyquist frequency of 48 kHz
+	input := tone(30000, 96000, 96000)
+	got := rms(Resample(input, 96000, 48000))
+	if want := rms(input) * math.Pow(10, -60.0/20); got > want {
+		t.Errorf("30 kHz tone has rms %.2g after resampling to 48 kHz, want at most %.2g (-60 dB)", got, want)
+	}
+}
+
+func TestRatio(t *testing.T) {
+	check := func(to, from int, bound float64) {
+		t.Helper()
+		up, down := ratio(to, from)
+		if up > maxPhases {
+			t.Errorf("ratio(%d, %d) = %d/%d needs more than %d phases", to, from, up, down, maxPhases)
+		}
+		exact := float64(to) / float64(from)
+		if got := math.Abs(float64(up)/float64(down)/exact - 1); got >= bound {
+			t.Errorf("ratio(%d, %d) = %d/%d is off by %.2g, want under %.2g", to, from, up, down, got, bound)
+		}
+	}
+
+	common := []int{8000, 11025, 16000, 22050, 32000, 44100, 48000, 88200, 96000, 192000}
+	for _, to := range common {
+		for _, from := range common {
+			check(to, from, 1e-6)
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		check(1000+rng.Intn(200000), 1000+rng.Intn(200000), 1.0/maxPhases)
+	}
+}
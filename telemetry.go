@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"zham-app/db"
+	"zham-app/metrics"
+	"zham-app/models"
+	"zham-app/zham"
+
+	"github.com/gorilla/mux"
+)
+
+// Query pipeline stages, as the stage label of zham_query_stage_duration_seconds.
+const (
+	stageDecode      = "decode"
+	stageSpectrogram = "spectrogram"
+	stagePeaks       = "peaks"
+	stageFingerprint = "fingerprint"
+	stageLookup      = "lookup"
+	stageScoring     = "scoring"
+)
+
+// telemetry is what GET /metrics exposes.
+var telemetry = newServerMetrics()
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	requests       *metrics.Counter
+	requestSeconds *metrics.Histogram
+
+	stageSeconds *metrics.Histogram
+	peaks        *metrics.Histogram
+	hashes       *metrics.Histogram
+	candidates   *metrics.Histogram
+	queries      *metrics.Counter
+
+	indexAddresses *metrics.Gauge
+	indexCouples   *metrics.Gauge
+	indexSongs     *metrics.Gauge
+	indexBytes     *metrics.Gauge
+	memory         *metrics.Gauge
+}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:       r,
+		requests:       r.NewCounter("zham_http_requests_total", "HTTP requests by route, method and status code.", "route", "method", "code"),
+		requestSeconds: r.NewHistogram("zham_http_request_duration_seconds", "HTTP request latency by route and method.", metrics.DefaultBuckets, "route", "method"),
+		stageSeconds:   r.NewHistogram("zham_query_stage_duration_seconds", "Time a query spends in each stage of the recognition pipeline.", metrics.DefaultBuckets, "stage"),
+		peaks:          r.NewHistogram("zham_query_peaks", "Constellation peaks per query.", metrics.ExponentialBuckets(16, 2, 12)),
+		hashes:         r.NewHistogram("zham_query_hashes", "Fingerprint hashes per query.", metrics.ExponentialBuckets(64, 2, 12)),
+		candidates:     r.NewHistogram("zham_query_candidates", "Candidate songs returned per query.", []float64{0, 1, 2, 3, 5, 10, 20, 50}),
+		queries:        r.NewCounter("zham_queries_total", "Finished queries by source, post or live, and outcome, match or no_match.", "source", "outcome"),
+		indexAddresses: r.NewGauge("zham_index_addresses", "Distinct addresses in the index."),
+		indexCouples:   r.NewGauge("zham_index_couples", "Couples in the index."),
+		indexSongs:     r.NewGauge("zham_index_songs", "Songs with couples in the index."),
+		indexBytes:     r.NewGauge("zham_index_bytes", "Estimated memory held by the index."),
+		memory:         r.NewGauge("zham_memory_bytes", "Go heap in use and memory obtained from the OS.", "kind"),
+	}
+
+	r.OnCollect(func() {
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		m.memory.Set(float64(mem.HeapAlloc), "heap_alloc")
+		m.memory.Set(float64(mem.Sys), "sys")
+	})
+	return m
+}
+
+// watchIndex reports the size of index on every scrape.
+func (m *serverMetrics) watchIndex(index *db.Index) {
+	m.registry.OnCollect(func() {
+		stats := index.Stats()
+		m.indexAddresses.Set(float64(stats.Addresses))
+		m.indexCouples.Set(float64(stats.Couples))
+		m.indexSongs.Set(float64(stats.Songs))
+		m.indexBytes.Set(float64(stats.Bytes))
+	})
+}
+
+func (m *serverMetrics) stage(stage string, d time.Duration) {
+	m.stageSeconds.Observe(d.Seconds(), stage)
+}
+
+// query records the result of a query from source.
+func (m *serverMetrics) query(source string, peaks int, fingerprints map[uint32][]models.Couple, res []zham.Match) {
+	hashes := 0
+	for _, couples := range fingerprints {
+		hashes += len(couples)
+	}
+	m.peaks.Observe(float64(peaks))
+	m.hashes.Observe(float64(hashes))
+	m.candidates.Observe(float64(len(res)))
+
+	outcome := "no_match"
+	if len(res) > 0 && res[0].Confident {
+		outcome = "match"
+	}
+	m.queries.Inc(source, outcome)
+}
+
+// instrument is mux middleware counting and timing requests by route
+// template, so /zham/{songId} is one route however many songs are asked for.
+func (m *serverMetrics) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		m.requests.Inc(route, r.Method, strconv.Itoa(recorder.status))
+		m.requestSeconds.Observe(time.Since(start).Seconds(), route, r.Method)
+	})
+}
+
+// statusRecorder remembers the status code a handler answered with. It passes
+// hijacking through for the WebSocket upgrade of /zham/live.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.ResponseWriter.Write(p)
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer can't be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil && s.status == 0 {
+		s.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// lookupTimer is a store adding up the time spent in Lookup.
+type lookupTimer struct {
+	db.Store
+	elapsed time.Duration
+}
+
+func (l *lookupTimer) Lookup(addresses []uint32) ([]db.Res, error) {
+	start := time.Now()
+	res, err := l.Store.Lookup(addresses)
+	l.elapsed += time.Since(start)
+	return res, err
+}
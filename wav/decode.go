@@ -0,0 +1,127 @@
+package wav
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+const (
+	formatPCM   = 1
+	formatFloat = 3
+)
+
+// Audio holds decoded PCM audio, scaled to [-1, 1] and interleaved by channel.
+type Audio struct {
+	SampleRate int
+	Channels   int
+	BitDepth   int
+	Samples    []float64
+}
+
+// Decode parses an in-memory RIFF/WAVE file holding 8/16/24/32-bit integer
+// or 32/64-bit float PCM. Unknown chunks (LIST, fact, JUNK, ...) are skipped.
+func Decode(data []byte) (*Audio, error) {
+	chunks, err := Chunks(data)
+	if err != nil {
+		return nil, err
+	}
+
+	var format *Format
+	for _, c := range chunks {
+		switch c.ID {
+		case "fmt ":
+			f, err := parseFormat(c)
+			if err != nil {
+				return nil, err
+			}
+			format = &f
+
+		case "data":
+			if format == nil {
+				return nil, ErrNoFmtChunk
+			}
+			// drop a trailing partial frame left by a truncated upload
+			body := c.Data[:len(c.Data)-len(c.Data)%format.BlockAlign]
+			samples, err := pcmToSamples(body, format.Tag, format.BitDepth)
+			if err != nil {
+				return nil, err
+			}
+			return &Audio{SampleRate: format.SampleRate, Channels: format.Channels, BitDepth: format.BitDepth, Samples: samples}, nil
+		}
+	}
+
+	if format == nil {
+		return nil, ErrNoFmtChunk
+	}
+	return nil, ErrNoDataChunk
+}
+
+func pcmToSamples(input []byte, formatTag uint16, bitDepth int) ([]float64, error) {
+	width := bitDepth / 8
+	numSamples := len(input) / width
+	output := make([]float64, numSamples)
+
+	switch {
+	case formatTag == formatPCM && bitDepth == 8:
+		// 8-bit WAV is unsigned with a 128 midpoint
+		for i := range output {
+			output[i] = (float64(input[i]) - 128.0) / 128.0
+		}
+	case formatTag == formatPCM && bitDepth == 16:
+		for i := range output {
+			output[i] = float64(int16(binary.LittleEndian.Uint16(input[2*i:]))) / 32768.0
+		}
+	case formatTag == formatPCM && bitDepth == 24:
+		for i := range output {
+			b := input[3*i:]
+			v := int32(uint32(b[0])<<8|uint32(b[1])<<16|uint32(b[2])<<24) >> 8
+			output[i] = float64(v) / 8388608.0
+		}
+	case formatTag == formatPCM && bitDepth == 32:
+		for i := range output {
+			output[i] = float64(int32(binary.LittleEndian.Uint32(input[4*i:]))) / 2147483648.0
+		}
+	case formatTag == formatFloat && bitDepth == 32:
+		for i := range output {
+			output[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(input[4*i:])))
+		}
+	case formatTag == formatFloat && bitDepth == 64:
+		for i := range output {
+			output[i] = math.Float64frombits(binary.LittleEndian.Uint64(input[8*i:]))
+		}
+	default:
+		return nil, &FormatError{Field: "bit depth", Value: bitDepth, Unsupported: true}
+	}
+
+	return output, nil
+}
+
+// Mono downmixes the interleaved channels by averaging them.
+func (a *Audio) Mono() []float64 {
+	if a.Channels <= 1 {
+		return a.Samples
+	}
+
+	n := len(a.Samples) / a.Channels
+	output := make([]float64, n)
+	for i := range output {
+		sum := 0.0
+		for c := 0; c < a.Channels; c++ {
+			sum += a.Samples[i*a.Channels+c]
+		}
+		output[i] = sum / float64(a.Channels)
+	}
+
+	return output
+}
+
+// DecodeMono decodes a WAV file and downmixes it to mono. The samples are
+// returned at the file's own sample rate.
+func DecodeMono(data []byte) ([]float64, int, error) {
+	audio, err := Decode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return audio.Mono(), audio.SampleRate, nil
+}
@@ -0,0 +1,219 @@
+package wav
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+// chunk encodes a RIFF sub-chunk, adding the pad byte of an odd sized body.
+func chunk(id string, body []byte) []byte {
+	b := append([]byte(id), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...)
+	b = append(b, body...)
+	if len(body)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// riff wraps chunks in a RIFF/WAVE header.
+func riff(chunks ...[]byte) []byte {
+	var body []byte
+	for _, c := range chunks {
+		body = append(body, c...)
+	}
+	b := append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(4+len(body)))...)
+	b = append(b, "WAVE"...)
+	return append(b, body...)
+}
+
+// fmtChunk is a plain 16 byte "fmt " chunk.
+func fmtChunk(tag uint16, channels, rate, bits int) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, tag)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate*channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+	return chunk("fmt ", b)
+}
+
+// extensibleFmtChunk is a WAVE_FORMAT_EXTENSIBLE "fmt " chunk whose sub-format
+// GUID starts with subTag.
+func extensibleFmtChunk(subTag uint16, channels, rate, bits int) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, formatExtensible)
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate))
+	b = binary.LittleEndian.AppendUint32(b, uint32(rate*channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(channels*bits/8))
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits))
+	b = binary.LittleEndian.AppendUint16(b, 22)           // cbSize
+	b = binary.LittleEndian.AppendUint16(b, uint16(bits)) // valid bits
+	b = binary.LittleEndian.AppendUint32(b, 0)            // channel mask
+	b = binary.LittleEndian.AppendUint16(b, subTag)
+	b = append(b, "\x00\x00\x00\x00\x10\x00\x80\x00\x00\xaa\x00\x38\x9b\x71"...)
+	return chunk("fmt ", b)
+}
+
+func s16(values ...int16) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint16(b, uint16(v))
+	}
+	return b
+}
+
+func s24(values ...int32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = append(b, byte(v), byte(v>>8), byte(v>>16))
+	}
+	return b
+}
+
+func s32(values ...int32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+func f32(values ...float32) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(v))
+	}
+	return b
+}
+
+func f64(values ...float64) []byte {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return b
+}
+
+func sameSamples(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		channels int
+		bitDepth int
+		want     []float64
+	}{
+		{
+			name:     "8-bit PCM",
+			data:     riff(fmtChunk(formatPCM, 1, 8000, 8), chunk("data", []byte{0, 128, 192, 255})),
+			channels: 1, bitDepth: 8,
+			want: []float64{-1, 0, 0.5, 127.0 / 128},
+		},
+		{
+			name:     "16-bit PCM",
+			data:     riff(fmtChunk(formatPCM, 1, 44100, 16), chunk("data", s16(-32768, 0, 16384, 32767))),
+			channels: 1, bitDepth: 16,
+			want: []float64{-1, 0, 0.5, 32767.0 / 32768},
+		},
+		{
+			name:     "24-bit PCM",
+			data:     riff(fmtChunk(formatPCM, 1, 48000, 24), chunk("data", s24(-8388608, 0, 4194304, -1))),
+			channels: 1, bitDepth: 24,
+			want: []float64{-1, 0, 0.5, -1.0 / 8388608},
+		},
+		{
+			name:     "32-bit PCM",
+			data:     riff(fmtChunk(formatPCM, 1, 48000, 32), chunk("data", s32(math.MinInt32, 0, 1<<30))),
+			channels: 1, bitDepth: 32,
+			want: []float64{-1, 0, 0.5},
+		},
+		{
+			name:     "32-bit float",
+			data:     riff(fmtChunk(formatFloat, 1, 48000, 32), chunk("data", f32(-1, 0, 0.25))),
+			channels: 1, bitDepth: 32,
+			want: []float64{-1, 0, 0.25},
+		},
+		{
+			name:     "64-bit float",
+			data:     riff(fmtChunk(formatFloat, 1, 48000, 64), chunk("data", f64(-0.5, 0.125))),
+			channels: 1, bitDepth: 64,
+			want: []float64{-0.5, 0.125},
+		},
+		{
+			name:     "extensible PCM",
+			data:     riff(extensibleFmtChunk(formatPCM, 1, 48000, 16), chunk("data", s16(16384, -16384))),
+			channels: 1, bitDepth: 16,
+			want: []float64{0.5, -0.5},
+		},
+		{
+			name:     "extensible float",
+			data:     riff(extensibleFmtChunk(formatFloat, 2, 48000, 32), chunk("data", f32(0.25, -0.25))),
+			channels: 2, bitDepth: 32,
+			want: []float64{0.25, -0.25},
+		},
+		{
+			name:     "chunks around the audio",
+			data:     riff(chunk("JUNK", make([]byte, 7)), fmtChunk(formatPCM, 1, 8000, 16), chunk("fact", s32(2)), chunk("data", s16(8192, -8192)), chunk("LIST", []byte("INFO"))),
+			channels: 1, bitDepth: 16,
+			want: []float64{0.25, -0.25},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			audio, err := Decode(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if audio.Channels != tt.channels || audio.BitDepth != tt.bitDepth {
+				t.Errorf("decoded %d channels of %d bits, want %d of %d", audio.Channels, audio.BitDepth, tt.channels, tt.bitDepth)
+			}
+			if !sameSamples(audio.Samples, tt.want) {
+				t.Errorf("samples = %v, want %v", audio.Samples, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMonoDownmixesStereo(t *testing.T) {
+	data := riff(fmtChunk(formatPCM, 2, 22050, 16), chunk("data", s16(16384, 0, -32768, -32768, 8192, -8192)))
+
+	samples, rate, err := DecodeMono(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 22050 {
+		t.Errorf("sample rate = %d, want 22050", rate)
+	}
+	if want := []float64{0.25, -1, 0}; !sameSamples(samples, want) {
+		t.Errorf("samples = %v, want %v", samples, want)
+	}
+}
+
+func TestDecodeTruncatedData(t *testing.T) {
+	// a streaming encoder's header claims more audio than was written, and
+	// the upload stopped part way through the third stereo frame
+	data := riff(fmtChunk(formatPCM, 2, 8000, 16))
+	data = append(data, "data"...)
+	data = binary.LittleEndian.AppendUint32(data, 1<<20)
+	data = append(data, s16(16384, 16384, -16384, -16384, 100)...)
+
+	samples, _, err := DecodeMono(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{0.5, -0.5}; !sameSamples(samples, want) {
+		t.Errorf("samples = %v, want %v", samples, want)
+	}
+}
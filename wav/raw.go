@@ -0,0 +1,66 @@
+package wav
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RawFormat describes headerless interleaved PCM, as streamed by clients that
+// can't send a WAV file.
+type RawFormat struct {
+	SampleRate int
+	Channels   int
+	// Encoding is one of u8, s16le, s24le, s32le, f32le or f64le.
+	Encoding string
+}
+
+type rawEncoding struct {
+	tag      uint16
+	bitDepth int
+}
+
+var rawEncodings = map[string]rawEncoding{
+	"u8":    {formatPCM, 8},
+	"s16le": {formatPCM, 16},
+	"s24le": {formatPCM, 24},
+	"s32le": {formatPCM, 32},
+	"f32le": {formatFloat, 32},
+	"f64le": {formatFloat, 64},
+}
+
+// Validate checks the format the same way a fmt chunk is checked.
+func (f RawFormat) Validate() error {
+	if _, ok := rawEncodings[strings.ToLower(f.Encoding)]; !ok {
+		return fmt.Errorf("%w: encoding %q", ErrUnsupported, f.Encoding)
+	}
+	if f.Channels < 1 || f.Channels > maxChannels {
+		return &FormatError{Field: "channel count", Value: f.Channels, Unsupported: f.Channels > maxChannels}
+	}
+	if f.SampleRate < minSampleRate || f.SampleRate > maxSampleRate {
+		return &FormatError{Field: "sample rate", Value: f.SampleRate}
+	}
+	return nil
+}
+
+// FrameSize is the number of bytes holding one sample of every channel.
+func (f RawFormat) FrameSize() int {
+	return rawEncodings[strings.ToLower(f.Encoding)].bitDepth / 8 * f.Channels
+}
+
+// Mono decodes whole frames of data and downmixes them, failing like Validate
+// for a format it can't decode. A trailing partial frame is dropped.
+func (f RawFormat) Mono(data []byte) ([]float64, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	enc := rawEncodings[strings.ToLower(f.Encoding)]
+	data = data[:len(data)-len(data)%f.FrameSize()]
+
+	samples, err := pcmToSamples(data, enc.tag, enc.bitDepth)
+	if err != nil {
+		return nil, err
+	}
+
+	audio := Audio{SampleRate: f.SampleRate, Channels: f.Channels, BitDepth: enc.bitDepth, Samples: samples}
+	return audio.Mono(), nil
+}
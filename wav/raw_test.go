@@ -0,0 +1,52 @@
+package wav
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRawFormatMono(t *testing.T) {
+	tests := []struct {
+		name   string
+		format RawFormat
+		data   []byte
+		want   []float64
+	}{
+		{"s16le mono", RawFormat{SampleRate: 16000, Channels: 1, Encoding: "s16le"}, s16(16384, -32768), []float64{0.5, -1}},
+		{"s16le stereo", RawFormat{SampleRate: 16000, Channels: 2, Encoding: "s16le"}, s16(16384, 0, -16384, -16384), []float64{0.25, -0.5}},
+		{"upper case encoding", RawFormat{SampleRate: 16000, Channels: 1, Encoding: "F32LE"}, f32(0.75), []float64{0.75}},
+		{"u8", RawFormat{SampleRate: 8000, Channels: 1, Encoding: "u8"}, []byte{0, 128}, []float64{-1, 0}},
+		{"partial frame dropped", RawFormat{SampleRate: 16000, Channels: 2, Encoding: "s16le"}, append(s16(16384, 16384), 1, 2), []float64{0.5}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.format.Mono(tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameSamples(got, tt.want) {
+				t.Errorf("samples = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRawFormatMonoRejectsInvalidFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format RawFormat
+		want   error
+	}{
+		{"unknown encoding", RawFormat{SampleRate: 16000, Channels: 1, Encoding: "mp3"}, ErrUnsupported},
+		{"no channels", RawFormat{SampleRate: 16000, Channels: 0, Encoding: "s16le"}, ErrInvalidFormat},
+		{"too many channels", RawFormat{SampleRate: 16000, Channels: 6, Encoding: "s16le"}, ErrUnsupported},
+		{"sample rate", RawFormat{SampleRate: 10, Channels: 1, Encoding: "s16le"}, ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.format.Mono(s16(1, 2, 3, 4)); !errors.Is(err, tt.want) {
+				t.Errorf("error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
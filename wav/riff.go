@@ -0,0 +1,175 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	formatExtensible = 0xFFFE
+
+	maxChannels   = 2
+	minSampleRate = 1000
+	maxSampleRate = 384000
+)
+
+var (
+	// ErrNotRIFF is returned when the input doesn't start with a RIFF/WAVE header.
+	ErrNotRIFF = errors.New("wav: not a RIFF/WAVE file")
+	// ErrNoFmtChunk is returned when no "fmt " chunk precedes the audio data.
+	ErrNoFmtChunk = errors.New("wav: missing fmt chunk")
+	// ErrNoDataChunk is returned when the file has no "data" chunk.
+	ErrNoDataChunk = errors.New("wav: missing data chunk")
+	// ErrUnsupported is returned for well formed files using an encoding the
+	// native decoder doesn't handle (ADPCM, A-law, more than two channels, ...).
+	ErrUnsupported = errors.New("wav: unsupported audio format")
+	// ErrInvalidFormat is returned when the fmt chunk holds impossible values.
+	ErrInvalidFormat = errors.New("wav: invalid format")
+)
+
+// ChunkError reports a chunk whose header or size doesn't fit in the file.
+type ChunkError struct {
+	ID     string
+	Offset int
+	Reason string
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("wav: malformed %q chunk at offset %d: %s", e.ID, e.Offset, e.Reason)
+}
+
+// FormatError reports a fmt chunk field that is either invalid or unsupported.
+type FormatError struct {
+	Field       string
+	Value       int
+	Unsupported bool
+}
+
+func (e *FormatError) Error() string {
+	if e.Unsupported {
+		return fmt.Sprintf("wav: unsupported %s %d", e.Field, e.Value)
+	}
+	return fmt.Sprintf("wav: invalid %s %d", e.Field, e.Value)
+}
+
+func (e *FormatError) Unwrap() error {
+	if e.Unsupported {
+		return ErrUnsupported
+	}
+	return ErrInvalidFormat
+}
+
+// Chunk is a single RIFF sub-chunk. Data aliases the input buffer.
+type Chunk struct {
+	ID     string
+	Offset int
+	Data   []byte
+}
+
+// Format is the decoded content of a "fmt " chunk. For WAVE_FORMAT_EXTENSIBLE
+// files Tag holds the sub-format.
+type Format struct {
+	Tag        uint16
+	Channels   int
+	SampleRate int
+	ByteRate   int
+	BlockAlign int
+	BitDepth   int
+}
+
+// Chunks walks the sub-chunks of a RIFF/WAVE file. A data chunk whose declared
+// size runs past the end of the input (as written by streaming encoders) is
+// truncated to what is available, any other overrun is an error.
+func Chunks(data []byte) ([]Chunk, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, ErrNotRIFF
+	}
+
+	var chunks []Chunk
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			// trailing garbage shorter than a chunk header is ignored
+			if len(chunks) > 0 {
+				break
+			}
+			return nil, &ChunkError{ID: "", Offset: pos, Reason: "truncated chunk header"}
+		}
+
+		id := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		end := pos + 8 + size
+
+		if end > len(data) {
+			if id != "data" {
+				return nil, &ChunkError{ID: id, Offset: pos, Reason: fmt.Sprintf("size %d exceeds file length", size)}
+			}
+			end = len(data)
+		}
+
+		chunks = append(chunks, Chunk{ID: id, Offset: pos, Data: data[pos+8 : end]})
+
+		// chunks are word aligned, odd sized chunks carry a pad byte
+		pos = end + (end-pos)&1
+	}
+
+	return chunks, nil
+}
+
+func parseFormat(c Chunk) (Format, error) {
+	body := c.Data
+	if len(body) < 16 {
+		return Format{}, &ChunkError{ID: c.ID, Offset: c.Offset, Reason: fmt.Sprintf("%d bytes, want at least 16", len(body))}
+	}
+
+	f := Format{
+		Tag:        binary.LittleEndian.Uint16(body[0:2]),
+		Channels:   int(binary.LittleEndian.Uint16(body[2:4])),
+		SampleRate: int(binary.LittleEndian.Uint32(body[4:8])),
+		ByteRate:   int(binary.LittleEndian.Uint32(body[8:12])),
+		BlockAlign: int(binary.LittleEndian.Uint16(body[12:14])),
+		BitDepth:   int(binary.LittleEndian.Uint16(body[14:16])),
+	}
+
+	if f.Tag == formatExtensible {
+		// cbSize(2) validBits(2) channelMask(4) subFormat GUID(16), the
+		// first two bytes of the GUID are the actual format tag
+		if len(body) < 40 {
+			return Format{}, &ChunkError{ID: c.ID, Offset: c.Offset, Reason: "extensible format shorter than 40 bytes"}
+		}
+		f.Tag = binary.LittleEndian.Uint16(body[24:26])
+	}
+
+	return f, f.validate()
+}
+
+func (f Format) validate() error {
+	switch f.Tag {
+	case formatPCM:
+		if f.BitDepth != 8 && f.BitDepth != 16 && f.BitDepth != 24 && f.BitDepth != 32 {
+			return &FormatError{Field: "PCM bit depth", Value: f.BitDepth, Unsupported: true}
+		}
+	case formatFloat:
+		if f.BitDepth != 32 && f.BitDepth != 64 {
+			return &FormatError{Field: "float bit depth", Value: f.BitDepth, Unsupported: true}
+		}
+	default:
+		return &FormatError{Field: "format tag", Value: int(f.Tag), Unsupported: true}
+	}
+
+	if f.Channels < 1 {
+		return &FormatError{Field: "channel count", Value: f.Channels}
+	}
+	if f.Channels > maxChannels {
+		return &FormatError{Field: "channel count", Value: f.Channels, Unsupported: true}
+	}
+	if f.SampleRate < minSampleRate || f.SampleRate > maxSampleRate {
+		return &FormatError{Field: "sample rate", Value: f.SampleRate}
+	}
+	if f.BlockAlign != f.Channels*f.BitDepth/8 {
+		return &FormatError{Field: "block align", Value: f.BlockAlign}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package wav
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+func TestDecodeErrors(t *testing.T) {
+	pcm := fmtChunk(formatPCM, 1, 8000, 16)
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"empty", nil, ErrNotRIFF},
+		{"not RIFF", []byte("ID3\x04\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00"), ErrNotRIFF},
+		{"RIFF but not WAVE", append([]byte("RIFF\x04\x00\x00\x00AVI "), chunk("data", nil)...), ErrNotRIFF},
+		{"no fmt chunk", riff(chunk("data", s16(1, 2))), ErrNoFmtChunk},
+		{"fmt after data", riff(chunk("data", s16(1, 2)), pcm), ErrNoFmtChunk},
+		{"no chunks", riff(), ErrNoFmtChunk},
+		{"no data chunk", riff(pcm, chunk("LIST", []byte("INFO"))), ErrNoDataChunk},
+		{"ADPCM", riff(fmtChunk(2, 1, 8000, 4), chunk("data", nil)), ErrUnsupported},
+		{"12-bit PCM", riff(fmtChunk(formatPCM, 1, 8000, 12), chunk("data", nil)), ErrUnsupported},
+		{"16-bit float", riff(fmtChunk(formatFloat, 1, 8000, 16), chunk("data", nil)), ErrUnsupported},
+		{"surround", riff(fmtChunk(formatPCM, 6, 8000, 16), chunk("data", nil)), ErrUnsupported},
+		{"extensible A-law", riff(extensibleFmtChunk(6, 1, 8000, 8), chunk("data", nil)), ErrUnsupported},
+		{"no channels", riff(fmtChunk(formatPCM, 0, 8000, 16), chunk("data", nil)), ErrInvalidFormat},
+		{"sample rate", riff(fmtChunk(formatPCM, 1, 100, 16), chunk("data", nil)), ErrInvalidFormat},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("error = %v, want %v", err, tt.want)
+			}
+			if !IsDecodeError(err) {
+				t.Errorf("IsDecodeError(%v) = false", err)
+			}
+		})
+	}
+}
+
+func TestDecodeFormatError(t *testing.T) {
+	badAlign := fmtChunk(formatPCM, 2, 8000, 16)
+	binary.LittleEndian.PutUint16(badAlign[8+12:], 3)
+
+	tests := []struct {
+		name string
+		data []byte
+		want FormatError
+	}{
+		{"bit depth", riff(fmtChunk(formatPCM, 1, 8000, 12), chunk("data", nil)), FormatError{Field: "PCM bit depth", Value: 12, Unsupported: true}},
+		{"format tag", riff(fmtChunk(0x55, 1, 8000, 16), chunk("data", nil)), FormatError{Field: "format tag", Value: 0x55, Unsupported: true}},
+		{"channels", riff(fmtChunk(formatPCM, 3, 8000, 16), chunk("data", nil)), FormatError{Field: "channel count", Value: 3, Unsupported: true}},
+		{"sample rate", riff(fmtChunk(formatPCM, 1, 500000, 16), chunk("data", nil)), FormatError{Field: "sample rate", Value: 500000}},
+		{"block align", riff(badAlign, chunk("data", nil)), FormatError{Field: "block align", Value: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			var formatErr *FormatError
+			if !errors.As(err, &formatErr) {
+				t.Fatalf("error = %v, want a *FormatError", err)
+			}
+			if *formatErr != tt.want {
+				t.Errorf("error = %+v, want %+v", *formatErr, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeChunkError(t *testing.T) {
+	shortFmt := riff(chunk("fmt ", make([]byte, 14)), chunk("data", nil))
+
+	overrun := riff(fmtChunk(formatPCM, 1, 8000, 16))
+	overrun = append(overrun, "LIST"...)
+	overrun = binary.LittleEndian.AppendUint32(overrun, 100)
+	overrun = append(overrun, "INFO"...)
+
+	shortExtensible := extensibleFmtChunk(formatPCM, 1, 8000, 16)[:8+30]
+	binary.LittleEndian.PutUint32(shortExtensible[4:], 30)
+
+	tests := []struct {
+		name string
+		data []byte
+		want ChunkError
+	}{
+		{"short fmt", shortFmt, ChunkError{ID: "fmt ", Offset: 12, Reason: "14 bytes, want at least 16"}},
+		{"chunk past the end", overrun, ChunkError{ID: "LIST", Offset: 36, Reason: "size 100 exceeds file length"}},
+		{"short extensible fmt", riff(shortExtensible, chunk("data", nil)), ChunkError{ID: "fmt ", Offset: 12, Reason: "extensible format shorter than 40 bytes"}},
+		{"truncated header", append([]byte("RIFF\x04\x00\x00\x00WAVE"), "dat"...), ChunkError{Offset: 12, Reason: "truncated chunk header"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.data)
+			var chunkErr *ChunkError
+			if !errors.As(err, &chunkErr) {
+				t.Fatalf("error = %v, want a *ChunkError", err)
+			}
+			if *chunkErr != tt.want {
+				t.Errorf("error = %+v, want %+v", *chunkErr, tt.want)
+			}
+			if !IsDecodeError(err) {
+				t.Errorf("IsDecodeError(%v) = false", err)
+			}
+		})
+	}
+}
+
+func TestChunksOddLengthList(t *testing.T) {
+	// the LIST body is 5 bytes, so a pad byte precedes the data chunk
+	data := riff(fmtChunk(formatPCM, 1, 8000, 16), chunk("LIST", []byte("INFOx")), chunk("data", s16(16384)))
+
+	chunks, err := Chunks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, c := range chunks {
+		ids = append(ids, c.ID)
+	}
+	if len(ids) != 3 || ids[1] != "LIST" || ids[2] != "data" {
+		t.Fatalf("chunks = %q, want fmt, LIST and data", ids)
+	}
+	if chunks[1].Offset != 36 || string(chunks[1].Data) != "INFOx" || chunks[2].Offset != 50 {
+		t.Errorf("LIST at %d holding %q, data at %d", chunks[1].Offset, chunks[1].Data, chunks[2].Offset)
+	}
+
+	samples, _, err := DecodeMono(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{0.5}; !sameSamples(samples, want) {
+		t.Errorf("samples = %v, want %v", samples, want)
+	}
+}
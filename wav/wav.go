@@ -14,8 +14,30 @@ import (
 	"zham-app/utils"
 )
 
+var (
+	// ErrMissingAudio is returned when the request carries no "audio" form file.
+	ErrMissingAudio = errors.New("wav: missing audio form file")
+	// ErrUndecodable is returned when ffmpeg couldn't convert an upload the
+	// native decoder doesn't support.
+	ErrUndecodable = errors.New("wav: audio could not be decoded")
+)
+
+// IsDecodeError reports whether err means the audio itself is unreadable, as
+// opposed to an I/O failure on our side.
+func IsDecodeError(err error) bool {
+	var chunkErr *ChunkError
+	return errors.Is(err, ErrNotRIFF) ||
+		errors.Is(err, ErrNoFmtChunk) ||
+		errors.Is(err, ErrNoDataChunk) ||
+		errors.Is(err, ErrUnsupported) ||
+		errors.Is(err, ErrInvalidFormat) ||
+		errors.Is(err, ErrUndecodable) ||
+		errors.As(err, &chunkErr)
+}
+
 // ReformatWAV converts a given WAV file to the specified number of channels,
-// either mono (1 channel) or stereo (2 channels).
+// either mono (1 channel) or stereo (2 channels). A resampleRate below 1
+// keeps the input's sample rate.
 func ConvertToWAV(inputFilePath string, channels int, resampleRate int) (string, error) {
 	if _, err := os.Stat(inputFilePath); err != nil {
 		return "", fmt.Errorf("input file does not exist: %v", err)
@@ -25,25 +47,22 @@ func ConvertToWAV(inputFilePath string, channels int, resampleRate int) (string,
 		channels = 1
 	}
 
-	if resampleRate < 1 {
-		resampleRate = 44100
-	}
-
 	fileExt := filepath.Ext(inputFilePath)
 	outputFile := strings.TrimSuffix(inputFilePath, fileExt) + "rfm.wav"
 
 	tmpFile := filepath.Join(filepath.Dir(outputFile), "tmp_"+filepath.Base(outputFile))
 	defer os.Remove(tmpFile)
 
-	cmd := exec.Command(
-		"ffmpeg",
+	args := []string{
 		"-y",
 		"-i", inputFilePath,
 		"-c", "pcm_s16le",
-		"-ar", fmt.Sprint(resampleRate),
 		"-ac", fmt.Sprint(channels),
-		tmpFile,
-	)
+	}
+	if resampleRate > 0 {
+		args = append(args, "-ar", fmt.Sprint(resampleRate))
+	}
+	cmd := exec.Command("ffmpeg", append(args, tmpFile)...)
 
 	output, err := cmd.CombinedOutput()
 	if err != nil {
@@ -77,54 +96,78 @@ func WavBytesToSamples(input []byte) ([]float64, error) {
 	return output, nil
 }
 
-func ConverterToWAV(r *http.Request, resampleRate int) ([]float64, error) {
+// ConverterToWAV reads the "audio" form file and returns its mono samples and
+// their sample rate. WAV uploads are decoded natively, anything else goes
+// through ffmpeg.
+func ConverterToWAV(r *http.Request) ([]float64, int, error) {
 	file, header, err := r.FormFile("audio")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create file")
+		return nil, 0, fmt.Errorf("%w: %v", ErrMissingAudio, err)
 	}
 	defer file.Close()
 
-	// fmt.Printf("Received file: %s\n", header.Filename)
-
-	uploadedPath := "/tmp/" + header.Filename
-	outputFile, err := os.Create(uploadedPath)
+	data, err := io.ReadAll(file)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create file in path %v, err %v", uploadedPath, err)
+		return nil, 0, fmt.Errorf("failed to read uploaded file: %v", err)
 	}
 
-	if _, err := io.Copy(outputFile, file); err != nil {
-		return nil, fmt.Errorf("failed to copy into file")
-	}
-	// defer outputFile.Close()
+	return decodeAny(data, filepath.Ext(header.Filename))
+}
 
-	wavFile, err := ConvertToWAV(uploadedPath, 1, resampleRate)
+// DecodeFile reads the audio file at path and returns its mono samples and
+// their sample rate, the same way ConverterToWAV handles an upload.
+func DecodeFile(path string) ([]float64, int, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("error: %v, output %v", err, string(wavFile))
+		return nil, 0, err
 	}
 
-	data, err := os.ReadFile(wavFile)
-	if err != nil {
-		return nil, err
-	}
+	return decodeAny(data, filepath.Ext(path))
+}
 
-	if len(data) < 44 {
-		return nil, errors.New("invalid WAV file size (too small)")
+// decodeAny decodes WAV data natively and anything else through ffmpeg. ext
+// is the original file extension, which helps ffmpeg pick the demuxer.
+func decodeAny(data []byte, ext string) ([]float64, int, error) {
+	sample, rate, err := DecodeMono(data)
+	if err == nil {
+		return sample, rate, nil
 	}
+	if !errors.Is(err, ErrNotRIFF) && !errors.Is(err, ErrUnsupported) {
+		return nil, 0, err
+	}
+
+	return convertWithFFmpeg(data, ext)
+}
 
-	byteData := data[44:]
-	sample, err := WavBytesToSamples(byteData)
+// convertWithFFmpeg is the fallback for compressed formats the native decoder
+// can't read. ffmpeg only decodes and downmixes, resampling is left to the
+// caller.
+func convertWithFFmpeg(data []byte, ext string) ([]float64, int, error) {
+	uploadedFile, err := os.CreateTemp("", "zham-*"+ext)
 	if err != nil {
-		return nil, errors.New("invalid WAV file size (too small)")
+		return nil, 0, fmt.Errorf("failed to create temp file, err %v", err)
 	}
+	uploadedPath := uploadedFile.Name()
+	defer utils.DeleteFile(uploadedPath)
 
-	utils.DeleteFile(wavFile)
+	if _, err := uploadedFile.Write(data); err != nil {
+		uploadedFile.Close()
+		return nil, 0, fmt.Errorf("failed to copy into file")
+	}
+	if err := uploadedFile.Close(); err != nil {
+		return nil, 0, err
+	}
 
-	err = outputFile.Close()
+	wavFile, err := ConvertToWAV(uploadedPath, 1, 0)
 	if err != nil {
-		fmt.Println("outputFile.Close() error", err)
+		return nil, 0, fmt.Errorf("%w: %v", ErrUndecodable, err)
 	}
+	defer utils.DeleteFile(wavFile)
 
-	utils.DeleteFile(uploadedPath)
+	wavData, err := os.ReadFile(wavFile)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	return sample, nil
+	return DecodeMono(wavData)
 }
@@ -0,0 +1,320 @@
+package ws
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// writeFrame writes a client frame, masked unless mask is nil. Tests whose
+// server hangs up part way through ignore the error.
+func writeFrame(w io.Writer, fin bool, opcode int, payload []byte, mask []byte) error {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	frame := []byte{b0}
+
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+
+	if mask != nil {
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame reads an unmasked server frame.
+func readFrame(t *testing.T, r io.Reader) (opcode int, payload []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("server frame header %08b %08b, want FIN set and no mask", header[0], header[1])
+	}
+
+	length := int(header[1])
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		length = int(binary.BigEndian.Uint64(ext[:]))
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return int(header[0] & 0x0F), payload
+}
+
+// readClose reads a close frame and returns its code.
+func readClose(t *testing.T, r io.Reader) int {
+	t.Helper()
+	opcode, payload := readFrame(t, r)
+	if opcode != OpClose || len(payload) < 2 {
+		t.Fatalf("got opcode %#x with %q, want a close frame", opcode, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+var testMask = []byte{0x12, 0x34, 0x56, 0x78}
+
+// pipe returns a server Conn and the client end of its connection.
+func pipe(t *testing.T) (*Conn, net.Conn) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &Conn{conn: server, br: bufio.NewReader(server)}, client
+}
+
+func TestAcceptKey(t *testing.T) {
+	// the example of RFC 6455 section 1.3
+	if got := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("acceptKey = %q", got)
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.WriteMessage(opcode, data)
+		conn.Close(CloseNormal, "")
+	}))
+	defer srv.Close()
+
+	client, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	io.WriteString(client, "GET / HTTP/1.1\r\nHost: zham\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	writeFrame(client, true, OpText, []byte("hello"), testMask)
+	if opcode, payload := readFrame(t, br); opcode != OpText || string(payload) != "hello" {
+		t.Errorf("echo = %#x %q", opcode, payload)
+	}
+	if code := readClose(t, br); code != CloseNormal {
+		t.Errorf("close code %d, want %d", code, CloseNormal)
+	}
+}
+
+func TestUpgradeRejectsBadHandshakes(t *testing.T) {
+	valid := func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Connection", "Upgrade")
+		r.Header.Set("Upgrade", "websocket")
+		r.Header.Set("Sec-WebSocket-Version", "13")
+		r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		return r
+	}
+
+	tests := []struct {
+		name   string
+		modify func(r *http.Request)
+	}{
+		{"POST", func(r *http.Request) { r.Method = http.MethodPost }},
+		{"no upgrade", func(r *http.Request) { r.Header.Del("Upgrade") }},
+		{"version", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Version", "8") }},
+		{"short key", func(r *http.Request) { r.Header.Set("Sec-WebSocket-Key", "c2hvcnQ=") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.modify(r)
+			if _, err := Upgrade(httptest.NewRecorder(), r); !errors.Is(err, ErrBadHandshake) {
+				t.Errorf("error = %v, want ErrBadHandshake", err)
+			}
+		})
+	}
+}
+
+func TestReadMaskedFrames(t *testing.T) {
+	conn, client := pipe(t)
+	long := []byte(strings.Repeat("zham", 100))
+	go func() {
+		writeFrame(client, true, OpBinary, []byte{1, 2, 3, 4, 5}, testMask)
+		writeFrame(client, true, OpBinary, long, testMask)
+	}()
+
+	for _, want := range [][]byte{{1, 2, 3, 4, 5}, long} {
+		opcode, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if opcode != OpBinary || string(data) != string(want) {
+			t.Errorf("got %#x with %d bytes, want a binary message of %d", opcode, len(data), len(want))
+		}
+	}
+}
+
+func TestReadRejectsUnmaskedFrames(t *testing.T) {
+	conn, client := pipe(t)
+	go func() {
+		writeFrame(client, true, OpText, []byte("hi"), nil)
+		if code := readClose(t, client); code != CloseProtocolError {
+			t.Errorf("close code %d, want %d", code, CloseProtocolError)
+		}
+		client.Close()
+	}()
+
+	var protoErr *ProtocolError
+	if _, _, err := conn.ReadMessage(); !errors.As(err, &protoErr) || protoErr.Code != CloseProtocolError {
+		t.Errorf("error = %v, want a 1002 ProtocolError", err)
+	}
+}
+
+func TestReadFragmentedWithPing(t *testing.T) {
+	conn, client := pipe(t)
+	go func() {
+		writeFrame(client, false, OpText, []byte("zh"), testMask)
+		writeFrame(client, true, OpPing, []byte("are you there"), testMask)
+		if opcode, payload := readFrame(t, client); opcode != OpPong || string(payload) != "are you there" {
+			t.Errorf("answer to the ping = %#x %q, want a pong echoing it", opcode, payload)
+		}
+		writeFrame(client, false, OpContinuation, []byte("a"), testMask)
+		writeFrame(client, true, OpContinuation, []byte("m!"), testMask)
+	}()
+
+	opcode, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opcode != OpText || string(data) != "zham!" {
+		t.Errorf("message = %#x %q, want text %q", opcode, data, "zham!")
+	}
+}
+
+func TestReadLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		frames [][]byte
+	}{
+		{"single frame", 10, [][]byte{make([]byte, 11)}},
+		{"fragments", 10, [][]byte{make([]byte, 6), make([]byte, 6)}},
+		{"default limit", 0, [][]byte{make([]byte, DefaultReadLimit+1)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, client := pipe(t)
+			conn.ReadLimit = tt.limit
+			go func() {
+				br := bufio.NewReader(client)
+				go func() {
+					for i, frame := range tt.frames {
+						op := OpBinary
+						if i > 0 {
+							op = OpContinuation
+						}
+						writeFrame(client, i == len(tt.frames)-1, op, frame, testMask)
+					}
+				}()
+				if code := readClose(t, br); code != CloseMessageTooBig {
+					t.Errorf("close code %d, want %d", code, CloseMessageTooBig)
+				}
+				client.Close()
+			}()
+
+			if _, _, err := conn.ReadMessage(); !errors.Is(err, ErrMessageTooBig) {
+				t.Errorf("error = %v, want ErrMessageTooBig", err)
+			}
+		})
+	}
+}
+
+func TestCloseHandshake(t *testing.T) {
+	t.Run("client first", func(t *testing.T) {
+		conn, client := pipe(t)
+		done := make(chan int, 1)
+		go func() {
+			payload := binary.BigEndian.AppendUint16(nil, CloseGoingAway)
+			writeFrame(client, true, OpClose, append(payload, "bye"...), testMask)
+			done <- readClose(t, client)
+			client.Close()
+		}()
+
+		var closeErr *CloseError
+		if _, _, err := conn.ReadMessage(); !errors.As(err, &closeErr) || *closeErr != (CloseError{Code: CloseGoingAway, Text: "bye"}) {
+			t.Errorf("error = %v, want the client's 1001 bye", err)
+		}
+		if code := <-done; code != CloseGoingAway {
+			t.Errorf("server answered the close with %d, want it echoed", code)
+		}
+		if err := conn.WriteMessage(OpText, []byte("late")); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("write after the close = %v, want net.ErrClosed", err)
+		}
+	})
+
+	t.Run("server first", func(t *testing.T) {
+		conn, client := pipe(t)
+		go func() {
+			opcode, payload := readFrame(t, client)
+			if opcode != OpClose || binary.BigEndian.Uint16(payload) != CloseNormal || string(payload[2:]) != "matched" {
+				t.Errorf("close frame = %#x %q", opcode, payload)
+			}
+			writeFrame(client, true, OpClose, payload[:2], testMask)
+			client.Close()
+		}()
+
+		if err := conn.Close(CloseNormal, "matched"); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.Close(CloseNormal, ""); err != nil {
+			t.Errorf("second close = %v, want a no-op", err)
+		}
+	})
+}
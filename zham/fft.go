@@ -1,7 +1,9 @@
 package zham
 
 import (
+	"fmt"
 	"math"
+	"math/cmplx"
 )
 
 func FFT(input []float64) []complex128 {
@@ -41,3 +43,143 @@ func recursiveFFT(complexArray []complex128) []complex128 {
 
 	return fftRes
 }
+
+// FFTPlan is an iterative radix-2 FFT for a fixed power-of-two size. The
+// bit-reversal permutation and the twiddle factors of every stage are computed
+// once, so repeated transforms don't allocate or call math.Cos/math.Sin.
+//
+// The twiddles use the same angles as recursiveFFT and the butterflies run in
+// the same order, so Transform gives bit-identical results to FFT and the
+// stored fingerprints stay valid.
+type FFTPlan struct {
+	n        int
+	rev      []int
+	twiddles []complex128 // stage of size m starts at index m/2-1
+}
+
+// NewFFTPlan returns a plan for transforms of size n, which must be a power of two.
+func NewFFTPlan(n int) (*FFTPlan, error) {
+	if n < 1 || n&(n-1) != 0 {
+		return nil, fmt.Errorf("fft size %d is not a power of two", n)
+	}
+
+	bits := 0
+	for 1<<bits < n {
+		bits++
+	}
+
+	rev := make([]int, n)
+	for i := range rev {
+		r := 0
+		for b := 0; b < bits; b++ {
+			if i&(1<<b) != 0 {
+				r |= 1 << (bits - 1 - b)
+			}
+		}
+		rev[i] = r
+	}
+
+	twiddles := make([]complex128, 0, max(n-1, 0))
+	for m := 2; m <= n; m <<= 1 {
+		for k := 0; k < m/2; k++ {
+			angle := (-2 * math.Pi * float64(k)) / float64(m)
+			twiddles = append(twiddles, complex(math.Cos(angle), math.Sin(angle)))
+		}
+	}
+
+	return &FFTPlan{n: n, rev: rev, twiddles: twiddles}, nil
+}
+
+// Size is the transform length of the plan.
+func (p *FFTPlan) Size() int {
+	return p.n
+}
+
+// Transform computes the FFT of buf in place. len(buf) must equal Size. A plan
+// holds no mutable state and can be shared between goroutines.
+func (p *FFTPlan) Transform(buf []complex128) {
+	for i, r := range p.rev {
+		if i < r {
+			buf[i], buf[r] = buf[r], buf[i]
+		}
+	}
+
+	for m := 2; m <= p.n; m <<= 1 {
+		half := m / 2
+		tw := p.twiddles[half-1 : m-1]
+		for start := 0; start < p.n; start += m {
+			for k := 0; k < half; k++ {
+				even := buf[start+k]
+				odd := buf[start+k+half]
+				buf[start+k] = even + tw[k]*odd
+				buf[start+k+half] = even - tw[k]*odd
+			}
+		}
+	}
+}
+
+// RealFFTPlan computes the FFT of real input of a fixed power-of-two size.
+// It packs the input into a complex signal of half the length, transforms
+// that with a half size FFTPlan and splits the result back into the spectrum
+// of the real signal, roughly halving the work of a complex transform.
+type RealFFTPlan struct {
+	n        int
+	half     *FFTPlan
+	twiddles []complex128 // e^(-2πik/n) for k <= n/2
+	scratch  []complex128
+}
+
+// NewRealFFTPlan returns a plan for real transforms of size n, which must be
+// a power of two and at least 2.
+func NewRealFFTPlan(n int) (*RealFFTPlan, error) {
+	if n < 2 || n%2 != 0 {
+		return nil, fmt.Errorf("real fft size %d is not a power of two of at least 2", n)
+	}
+
+	half, err := NewFFTPlan(n / 2)
+	if err != nil {
+		return nil, err
+	}
+
+	twiddles := make([]complex128, n/2+1)
+	for k := range twiddles {
+		angle := (-2 * math.Pi * float64(k)) / float64(n)
+		twiddles[k] = complex(math.Cos(angle), math.Sin(angle))
+	}
+
+	return &RealFFTPlan{n: n, half: half, twiddles: twiddles, scratch: make([]complex128, n/2)}, nil
+}
+
+// clone returns a plan sharing p's tables with a scratch buffer of its own.
+func (p *RealFFTPlan) clone() *RealFFTPlan {
+	c := *p
+	c.scratch = make([]complex128, len(p.scratch))
+	return &c
+}
+
+// Size is the transform length of the plan.
+func (p *RealFFTPlan) Size() int {
+	return p.n
+}
+
+// Transform writes the first Size/2+1 bins of the FFT of input into out, the
+// remaining bins being their complex conjugates. len(input) must equal Size
+// and out must hold at least Size/2+1 values. The plan's scratch buffer is
+// reused, so a plan must not be shared between goroutines.
+func (p *RealFFTPlan) Transform(input []float64, out []complex128) {
+	m := p.n / 2
+
+	z := p.scratch
+	for i := range z {
+		z[i] = complex(input[2*i], input[2*i+1])
+	}
+	p.half.Transform(z)
+
+	for k := 0; k <= m; k++ {
+		zk := z[k%m]
+		zc := cmplx.Conj(z[(m-k)%m])
+		even := (zk + zc) / 2
+		odd := (zk - zc) / complex(0, 2)
+		out[k] = even + p.twiddles[k]*odd
+	}
+}
@@ -0,0 +1,125 @@
+package zham
+
+import (
+	"math"
+	"math/cmplx"
+	"math/rand"
+	"testing"
+)
+
+func randomSignal(n int, seed int64) []float64 {
+	rng := rand.New(rand.NewSource(seed))
+	signal := make([]float64, n)
+	for i := range signal {
+		signal[i] = rng.Float64()*2 - 1
+	}
+	return signal
+}
+
+// TestFFTPlanMatchesFFT checks that the plan reproduces FFT bit for bit, which
+// keeps the fingerprints of stored songs valid.
+func TestFFTPlanMatchesFFT(t *testing.T) {
+	for n := 1; n <= 4096; n <<= 1 {
+		plan, err := NewFFTPlan(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for seed := int64(0); seed < 3; seed++ {
+			signal := randomSignal(n, seed)
+			want := FFT(signal)
+
+			got := make([]complex128, n)
+			for i, v := range signal {
+				got[i] = complex(v, 0)
+			}
+			plan.Transform(got)
+
+			for k := range want {
+				if math.Float64bits(real(got[k])) != math.Float64bits(real(want[k])) ||
+					math.Float64bits(imag(got[k])) != math.Float64bits(imag(want[k])) {
+					t.Fatalf("size %d seed %d bin %d: plan %v, FFT %v", n, seed, k, got[k], want[k])
+				}
+			}
+		}
+	}
+}
+
+func TestNewFFTPlanRejectsSizes(t *testing.T) {
+	for _, n := range []int{0, -2, 3, 1000} {
+		if _, err := NewFFTPlan(n); err == nil {
+			t.Errorf("NewFFTPlan(%d) accepted a size that isn't a power of two", n)
+		}
+	}
+}
+
+// TestRealFFTPlanMatchesFFT checks the real transform against FFT. The split
+// step rounds differently, so bins only agree to within a tolerance.
+func TestRealFFTPlanMatchesFFT(t *testing.T) {
+	for n := 2; n <= 4096; n <<= 1 {
+		plan, err := NewRealFFTPlan(n)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for seed := int64(0); seed < 3; seed++ {
+			signal := randomSignal(n, seed)
+			want := FFT(signal)
+
+			got := make([]complex128, n/2+1)
+			plan.Transform(signal, got)
+
+			tolerance := 1e-12 * float64(n)
+			for k := range got {
+				if d := cmplx.Abs(got[k] - want[k]); d > tolerance {
+					t.Fatalf("size %d seed %d bin %d: plan %v, FFT %v (off by %g)", n, seed, k, got[k], want[k], d)
+				}
+			}
+		}
+	}
+}
+
+func TestNewRealFFTPlanRejectsSizes(t *testing.T) {
+	for _, n := range []int{0, 1, 3, 1000} {
+		if _, err := NewRealFFTPlan(n); err == nil {
+			t.Errorf("NewRealFFTPlan(%d) accepted a size that isn't a power of two", n)
+		}
+	}
+}
+
+func BenchmarkFFT(b *testing.B) {
+	signal := randomSignal(freqBinSize, 1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		FFT(signal)
+	}
+}
+
+func BenchmarkFFTPlan(b *testing.B) {
+	signal := randomSignal(freqBinSize, 1)
+	plan, err := NewFFTPlan(freqBinSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	buf := make([]complex128, freqBinSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, v := range signal {
+			buf[j] = complex(v, 0)
+		}
+		plan.Transform(buf)
+	}
+}
+
+func BenchmarkRealFFTPlan(b *testing.B) {
+	signal := randomSignal(freqBinSize, 1)
+	plan, err := NewRealFFTPlan(freqBinSize)
+	if err != nil {
+		b.Fatal(err)
+	}
+	out := make([]complex128, freqBinSize/2+1)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		plan.Transform(signal, out)
+	}
+}
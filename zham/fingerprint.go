@@ -4,7 +4,15 @@ import (
 	"zham-app/models"
 )
 
+// Fingerprint pairs every peak with the targetZoneSize peaks after it and
+// returns the couples by address along with the number of pairs hashed.
 func Fingerprint(peaks []models.Peak, songID string, targetZoneSize int) (map[uint32][]models.Couple, int) {
+	return fingerprint(peaks, songID, targetZoneSize, 0xFFF, false)
+}
+
+// fingerprint is Fingerprint with a maximum delta. wrapDeltas keeps the
+// aliasing of profile version 1, see ProfileVersion.
+func fingerprint(peaks []models.Peak, songID string, targetZoneSize int, maxDeltaMs uint32, wrapDeltas bool) (map[uint32][]models.Couple, int) {
 	fingerprints := map[uint32][]models.Couple{}
 	zonesLength := 0
 
@@ -17,22 +25,21 @@ func Fingerprint(peaks []models.Peak, songID string, targetZoneSize int) (map[ui
 		for j := i; j < len(peaks) && j <= i+targetZoneSize; j++ {
 			target := peaks[j]
 
-			if uint32((target.Time-anchor.Time)*1000) <= 0xFFF {
+			if uint32((target.Time-anchor.Time)*1000) <= maxDeltaMs {
 				cnt++
 			}
 		}
 
 		if cnt >= targetZoneSize {
+			anchorTimeMs := uint32(anchor.Time * 1000)
 			for j := i; j < len(peaks) && j <= i+targetZoneSize; j++ {
-				target := peaks[j]
-				zonesLength++
-
-				address := createAddress(anchor, target)
-				anchorTimeMs := uint32(anchor.Time * 1000)
-
-				if _, ok := fingerprints[address]; !ok {
-					fingerprints[address] = []models.Couple{}
+				// a target too far ahead used to have its delta masked
+				// into the address, aliasing a closer target; skip it
+				address, ok := createAddress(anchor, peaks[j], maxDeltaMs, wrapDeltas)
+				if !ok {
+					continue
 				}
+				zonesLength++
 
 				fingerprints[address] = append(
 					fingerprints[address],
@@ -45,12 +52,60 @@ func Fingerprint(peaks []models.Peak, songID string, targetZoneSize int) (map[ui
 	return fingerprints, zonesLength
 }
 
-func createAddress(anchor, target models.Peak) uint32 {
-	anchorFreq := int(anchor.Freq)
-	targetFreq := int(target.Freq)
-	deltaTimeMs := uint32((target.Time - anchor.Time) * 1000)
+// An address packs one anchor/target pair into 32 bits, most significant
+// first:
+//
+//	bits 31-22  anchor frequency bin, 0..1023
+//	bits 21-12  target frequency bin, 0..1023
+//	bits 11-0   target time minus anchor time in ms, 0..4095
+//
+// The fields don't overlap, so two pairs share an address only if all three
+// values are equal. Frequency bins fit because FingerprintProfile.Validate
+// caps FreqBinSize at 2048 (1024 bins) and the delta because it caps
+// MaxDeltaMs at 4095.
+//
+// Profile version 1 masks an out of range delta into the low 12 bits, so a
+// target more than 4095ms past its anchor is stored under the address of a
+// much closer one. Version 2 skips such targets. The layout is the same in
+// both, but the couples differ, so a store keeps the version it was built
+// with.
+const (
+	addressFreqBits  = 10
+	addressDeltaBits = 12
+
+	addressFreqMask  = 1<<addressFreqBits - 1
+	addressDeltaMask = 1<<addressDeltaBits - 1
+
+	targetFreqShift = addressDeltaBits
+	anchorFreqShift = addressDeltaBits + addressFreqBits
+)
+
+// PackAddress builds the address of a pair. ok is false when a value doesn't
+// fit its field, rather than truncating it into a colliding address.
+func PackAddress(anchorFreq int, targetFreq int, deltaMs int) (address uint32, ok bool) {
+	if anchorFreq < 0 || anchorFreq > addressFreqMask ||
+		targetFreq < 0 || targetFreq > addressFreqMask ||
+		deltaMs < 0 || deltaMs > addressDeltaMask {
+		return 0, false
+	}
+
+	return uint32(anchorFreq)<<anchorFreqShift | uint32(targetFreq)<<targetFreqShift | uint32(deltaMs), true
+}
 
-	address := uint32(anchorFreq<<22) | uint32(targetFreq<<12) | (deltaTimeMs & 0xFFF)
+// UnpackAddress splits an address back into its fields.
+func UnpackAddress(address uint32) (anchorFreq int, targetFreq int, deltaMs int) {
+	return int(address >> anchorFreqShift & addressFreqMask),
+		int(address >> targetFreqShift & addressFreqMask),
+		int(address & addressDeltaMask)
+}
+
+func createAddress(anchor, target models.Peak, maxDeltaMs uint32, wrapDeltas bool) (uint32, bool) {
+	deltaTimeMs := uint32((target.Time - anchor.Time) * 1000)
+	if wrapDeltas {
+		deltaTimeMs &= addressDeltaMask
+	} else if deltaTimeMs > maxDeltaMs {
+		return 0, false
+	}
 
-	return address //uint32(address)
+	return PackAddress(int(anchor.Freq), int(target.Freq), int(deltaTimeMs))
 }
@@ -0,0 +1,97 @@
+package zham
+
+import (
+	"testing"
+
+	"zham-app/models"
+)
+
+// TestAddressFieldsIndependent packs every value of each field against
+// every value of the others at their extremes, and every anchor/target pair
+// against the delta extremes, checking each field unpacks unchanged and only
+// occupies its own bits.
+func TestAddressFieldsIndependent(t *testing.T) {
+	freqs := []int{0, 1, addressFreqMask / 2, addressFreqMask}
+	deltas := []int{0, 1, addressDeltaMask / 2, addressDeltaMask}
+
+	check := func(anchorFreq, targetFreq, deltaMs int) {
+		address, ok := PackAddress(anchorFreq, targetFreq, deltaMs)
+		if !ok {
+			t.Fatalf("PackAddress(%d, %d, %d) rejected in range values", anchorFreq, targetFreq, deltaMs)
+		}
+		a, tf, d := UnpackAddress(address)
+		if a != anchorFreq || tf != targetFreq || d != deltaMs {
+			t.Fatalf("PackAddress(%d, %d, %d) unpacks to (%d, %d, %d)", anchorFreq, targetFreq, deltaMs, a, tf, d)
+		}
+
+		// each field alone, the others zero, must OR back into the address
+		// without overlapping
+		onlyAnchor, _ := PackAddress(anchorFreq, 0, 0)
+		onlyTarget, _ := PackAddress(0, targetFreq, 0)
+		onlyDelta, _ := PackAddress(0, 0, deltaMs)
+		if onlyAnchor&onlyTarget != 0 || onlyAnchor&onlyDelta != 0 || onlyTarget&onlyDelta != 0 ||
+			onlyAnchor|onlyTarget|onlyDelta != address {
+			t.Fatalf("fields of PackAddress(%d, %d, %d) overlap", anchorFreq, targetFreq, deltaMs)
+		}
+	}
+
+	for anchorFreq := 0; anchorFreq <= addressFreqMask; anchorFreq++ {
+		for targetFreq := 0; targetFreq <= addressFreqMask; targetFreq++ {
+			for _, deltaMs := range deltas {
+				check(anchorFreq, targetFreq, deltaMs)
+			}
+		}
+	}
+	for deltaMs := 0; deltaMs <= addressDeltaMask; deltaMs++ {
+		for _, anchorFreq := range freqs {
+			for _, targetFreq := range freqs {
+				check(anchorFreq, targetFreq, deltaMs)
+			}
+		}
+	}
+}
+
+func TestPackAddressOutOfRange(t *testing.T) {
+	for _, fields := range [][3]int{
+		{-1, 0, 0},
+		{addressFreqMask + 1, 0, 0},
+		{0, -1, 0},
+		{0, addressFreqMask + 1, 0},
+		{0, 0, -1},
+		{0, 0, addressDeltaMask + 1},
+	} {
+		if address, ok := PackAddress(fields[0], fields[1], fields[2]); ok {
+			t.Errorf("PackAddress%v = %#x, want rejected", fields, address)
+		}
+	}
+}
+
+// TestFingerprintVersions checks that a target past MaxDeltaMs is aliased
+// under profile version 1 and skipped from version 2 on.
+func TestFingerprintVersions(t *testing.T) {
+	// the zone of the first anchor qualifies with four close targets while
+	// the fifth lies 5s ahead
+	peaks := []models.Peak{
+		{Time: 0, Freq: 10},
+		{Time: 0.1, Freq: 20},
+		{Time: 0.2, Freq: 30},
+		{Time: 0.3, Freq: 40},
+		{Time: 0.4, Freq: 50},
+		{Time: 5.0, Freq: 60},
+	}
+	far, _ := PackAddress(10, 60, 5000&addressDeltaMask)
+
+	legacy := LegacyProfile()
+	legacy.TargetZoneSize = 5
+	v1, hashed1 := legacy.Fingerprint(peaks, "song")
+	if _, ok := v1[far]; !ok || hashed1 != 6 {
+		t.Errorf("version 1 hashed %d pairs, aliased address present: %v; want 6 and true", hashed1, ok)
+	}
+
+	current := DefaultProfile()
+	current.TargetZoneSize = 5
+	v2, hashed2 := current.Fingerprint(peaks, "song")
+	if _, ok := v2[far]; ok || hashed2 != 5 {
+		t.Errorf("version %d hashed %d pairs, aliased address present: %v; want 5 and false", current.Version, hashed2, ok)
+	}
+}
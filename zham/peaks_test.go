@@ -0,0 +1,170 @@
+package zham
+
+import (
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+
+	"zham-app/models"
+)
+
+// baselineGetPeaks is GetPeaks as the baseline shipped it, copied verbatim
+// apart from its name. It picked the peaks of a whole spectrogram at once;
+// PeakFinder has to reproduce it exactly, or stored fingerprints stop
+// matching.
+func baselineGetPeaks(spectrogram [][]float64, time []float64, dist_time int, dist_freq int, coeff int) []models.Peak {
+
+	type maxStruct struct {
+		maxFreqAmplitude float64
+		Freq             int32
+		Time             float64
+	}
+
+	N := len(spectrogram)
+	K := len(spectrogram[0])
+
+	bands := getLogBands(6000.0, 300.0, 30, float64(K))
+	E := make([][]maxStruct, N)
+	var peaks []models.Peak
+
+	for i, bin := range spectrogram {
+		bandsEnergies := make([]maxStruct, len(bin))
+		for bi, band := range bands {
+			var maxMag maxStruct
+			for pos := band.min; pos < band.max; pos++ {
+				mag := bin[pos]
+				if mag > maxMag.maxFreqAmplitude {
+					maxMag = maxStruct{mag, pos, time[i]}
+				}
+			}
+			bandsEnergies[bi] = maxMag
+		}
+		E[i] = bandsEnergies
+	}
+
+	K = len(E[0])
+	C := make([][]bool, N)
+
+	for s := range C {
+		C[s] = make([]bool, K)
+	}
+
+	sum := 0.0
+	num := 0
+
+	for n, bin := range E {
+		for k := range bin {
+			mag := bin[k].maxFreqAmplitude
+			startN := max(0, n-dist_time)
+			endN := min(N, n+dist_time)
+
+			startK := max(0, k-dist_freq)
+			endK := min(K, k+dist_freq)
+
+			ok := true
+
+			for i := startN; i < endN; i++ {
+				for j := startK; j < endK; j++ {
+					if i != n && j != k && E[i][j].maxFreqAmplitude > mag {
+						ok = false
+						break
+					}
+				}
+				if !ok {
+					break
+				}
+			}
+
+			if ok {
+				C[n][k] = true
+				sum += mag
+				num++
+			}
+		}
+	}
+
+	mean := sum / float64(num)
+	stdDev := 0.0
+	for n, bin := range C {
+		for k := range bin {
+			if bin[k] {
+				stdDev += math.Pow(E[n][k].maxFreqAmplitude-mean, 2)
+			}
+		}
+	}
+	stdDev = math.Sqrt(stdDev / float64(num))
+	avg := mean + stdDev
+
+	for n, bin := range C {
+		for k := range bin {
+			if bin[k] {
+				ref := E[n][k]
+				if ref.maxFreqAmplitude >= avg {
+					peaks = append(peaks, models.Peak{Time: ref.Time, Freq: ref.Freq})
+				}
+			}
+		}
+	}
+
+	sort.Slice(peaks, func(i, j int) bool {
+		if peaks[i].Time != peaks[j].Time {
+			return peaks[i].Time < peaks[j].Time
+		}
+		return peaks[i].Freq < peaks[j].Freq // if same time, sort in ascending freq
+	})
+
+	return peaks
+}
+
+func TestPeakFinderMatchesBaseline(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for _, dist := range []struct{ time, freq int }{{11, 5}, {1, 1}, {3, 40}} {
+		p := LegacyProfile()
+		p.PeakDistTime, p.PeakDistFreq = dist.time, dist.freq
+		finder := p.NewPeakFinder()
+
+		var spectrogram [][]float64
+		var times []float64
+		for n := 0; n < 300; n++ {
+			frame := Frame{Time: float64(n) * 0.005, Magnitudes: make([]float64, finder.width)}
+			for k := range frame.Magnitudes {
+				frame.Magnitudes[k] = rng.Float64()*100 - 30
+			}
+			finder.Add(frame)
+			spectrogram = append(spectrogram, frame.Magnitudes)
+			times = append(times, frame.Time)
+
+			// live sessions ask for peaks part way through
+			if n%37 == 0 || n == 299 {
+				want := baselineGetPeaks(spectrogram, times, dist.time, dist.freq, 0)
+				if got := finder.Peaks(); !reflect.DeepEqual(got, want) {
+					t.Fatalf("dist %v after %d frames: %d peaks, baseline %d", dist, n+1, len(got), len(want))
+				}
+			}
+		}
+
+		if len(finder.window) > 2*dist.time+1 {
+			t.Errorf("dist %v: %d frames of band maxima kept", dist, len(finder.window))
+		}
+	}
+}
+
+func TestPeakFinderSilence(t *testing.T) {
+	finder := LegacyProfile().NewPeakFinder()
+	var spectrogram [][]float64
+	var times []float64
+	for n := 0; n < 20; n++ {
+		frame := Frame{Time: float64(n), Magnitudes: make([]float64, finder.width)}
+		finder.Add(frame)
+		spectrogram = append(spectrogram, frame.Magnitudes)
+		times = append(times, frame.Time)
+	}
+
+	want := baselineGetPeaks(spectrogram, times, 11, 5, 0)
+	if got := finder.Peaks(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%d peaks of silence, baseline %d", len(got), len(want))
+	}
+}
@@ -0,0 +1,293 @@
+package zham
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"zham-app/db"
+	"zham-app/models"
+	"zham-app/resample"
+)
+
+// ProfileVersion is bumped whenever the fingerprinting code changes in a way
+// the profile parameters don't capture, e.g. the address layout. Older
+// versions stay supported so existing stores keep matching:
+//
+//	1  a target more than MaxDeltaMs past its anchor has its delta masked
+//	   into the address, aliasing a closer target
+//	2  such targets are skipped
+const ProfileVersion = 2
+
+// Resampler choices of a FingerprintProfile.
+const (
+	// ResamplerSinc converts audio with resample.Sinc and decimates it for
+	// the spectrogram with a windowed-sinc low-pass.
+	ResamplerSinc = "sinc"
+	// ResamplerFFmpeg converts audio with resample.FFmpeg, which needs ffmpeg
+	// installed, and decimates with a one-pole low-pass and group averages.
+	// It is what every store made before the native WAV decoder was built
+	// with.
+	ResamplerFFmpeg = "ffmpeg"
+)
+
+// ErrProfileMismatch is returned when a store holds couples made with a
+// different fingerprint profile than the one in use. Its addresses would
+// never line up with the query's, so the store has to be re-ingested.
+var ErrProfileMismatch = errors.New("zham: fingerprint profile does not match the store")
+
+// FingerprintProfile is every parameter that affects the fingerprints of a
+// song. Couples made with different profiles can't be matched against each
+// other, so the profile is recorded with the store.
+type FingerprintProfile struct {
+	// Version is the fingerprinting code version, see ProfileVersion. 0
+	// leaves it to CheckProfile: the store's version, or ProfileVersion for
+	// a new store.
+	Version int
+
+	// SampleRate is the rate audio is resampled to before the spectrogram.
+	SampleRate int
+	// CutoffHz is the low-pass cutoff applied before downsampling by
+	// DSPRatio.
+	CutoffHz float64
+	DSPRatio int
+	// Resampler is ResamplerSinc or ResamplerFFmpeg. Empty leaves it to
+	// CheckProfile like Version; a store recorded without one was made with
+	// ffmpeg, so an empty Resampler that stays empty means ResamplerFFmpeg.
+	Resampler string
+	// FreqBinSize is the FFT size and HopSize the step between windows, in
+	// downsampled samples.
+	FreqBinSize int
+	HopSize     int
+
+	// NumBands log-spaced bands between MinBandHz and MaxBandHz, MaxBandHz
+	// being taken as the top of the spectrum.
+	MinBandHz float64
+	MaxBandHz float64
+	NumBands  int
+
+	// PeakDistTime and PeakDistFreq are the neighbourhood, in frames and
+	// bands, a peak has to dominate.
+	PeakDistTime int
+	PeakDistFreq int
+
+	// TargetZoneSize is how many following peaks each anchor is paired with,
+	// and MaxDeltaMs how far ahead they may be.
+	TargetZoneSize int
+	MaxDeltaMs     int
+}
+
+// DefaultProfile is the profile new stores are built with.
+func DefaultProfile() FingerprintProfile {
+	p := LegacyProfile()
+	p.Version = ProfileVersion
+	p.Resampler = ResamplerSinc
+	return p
+}
+
+// LegacyProfile is the profile every store was built with before profiles
+// were recorded, when uploads were converted to 48kHz by ffmpeg.
+//
+// Its fingerprints can only be reproduced with ffmpeg, so a store on it needs
+// ffmpeg installed and starts an ffmpeg process for every upload, query and
+// live session that isn't already at 48kHz, which costs far more than the
+// in-process DefaultProfile. Re-ingesting into a new store moves off it.
+func LegacyProfile() FingerprintProfile {
+	return FingerprintProfile{
+		Version:        1,
+		SampleRate:     48000,
+		CutoffHz:       maxFreq,
+		DSPRatio:       dspRatio,
+		Resampler:      ResamplerFFmpeg,
+		FreqBinSize:    freqBinSize,
+		HopSize:        hopSize,
+		MinBandHz:      300,
+		MaxBandHz:      6000,
+		NumBands:       30,
+		PeakDistTime:   11,
+		PeakDistFreq:   5,
+		TargetZoneSize: 5,
+		MaxDeltaMs:     0xFFF,
+	}
+}
+
+// ID identifies the profile: its version and a digest of its parameters.
+func (p FingerprintProfile) ID() string {
+	data, _ := json.Marshal(p)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("v%d-%s", p.Version, hex.EncodeToString(sum[:6]))
+}
+
+func (p FingerprintProfile) Validate() error {
+	var errs []error
+	check := func(ok bool, field string, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+		}
+	}
+
+	check(p.Version >= 0 && p.Version <= ProfileVersion, "Version", "%d is not supported, this build fingerprints versions 1..%d", p.Version, ProfileVersion)
+	check(p.SampleRate >= 8000 && p.SampleRate <= 192000, "SampleRate", "%d is outside 8000..192000", p.SampleRate)
+	check(p.CutoffHz > 0, "CutoffHz", "must be positive")
+	check(p.DSPRatio > 0, "DSPRatio", "must be positive")
+	check(p.Resampler == "" || p.Resampler == ResamplerSinc || p.Resampler == ResamplerFFmpeg,
+		"Resampler", "%q is not %q or %q", p.Resampler, ResamplerSinc, ResamplerFFmpeg)
+	check(p.Resampler != ResamplerSinc || p.DSPRatio <= 0 || p.SampleRate%p.DSPRatio == 0, "DSPRatio", "must divide SampleRate")
+	// frequency bins and deltas have to fit their address fields, see
+	// PackAddress
+	check(p.FreqBinSize >= 64 && p.FreqBinSize/2 <= addressFreqMask+1 && p.FreqBinSize&(p.FreqBinSize-1) == 0, "FreqBinSize", "%d is not a power of two in 64..2048", p.FreqBinSize)
+	check(p.HopSize > 0 && p.HopSize <= p.FreqBinSize, "HopSize", "must be in 1..FreqBinSize")
+	check(p.MinBandHz > 0 && p.MinBandHz < p.MaxBandHz, "MinBandHz", "must be positive and below MaxBandHz")
+	check(p.NumBands >= 2, "NumBands", "must be at least 2")
+	check(p.PeakDistTime > 0, "PeakDistTime", "must be positive")
+	check(p.PeakDistFreq > 0, "PeakDistFreq", "must be positive")
+	check(p.TargetZoneSize > 0, "TargetZoneSize", "must be positive")
+	check(p.MaxDeltaMs > 0 && p.MaxDeltaMs <= addressDeltaMask, "MaxDeltaMs", "must be in 1..4095")
+
+	return errors.Join(errs...)
+}
+
+// NewResampler returns the profile's resampler from fromRate to p.SampleRate.
+// An FFmpeg resampler has to be flushed or closed.
+func (p FingerprintProfile) NewResampler(fromRate int) (resample.Resampler, error) {
+	if p.Resampler == ResamplerSinc {
+		return resample.NewSinc(fromRate, p.SampleRate, 0), nil
+	}
+	return resample.NewFFmpeg(fromRate, p.SampleRate)
+}
+
+// Resample converts mono samples at fromRate to p.SampleRate.
+func (p FingerprintProfile) Resample(samples []float64, fromRate int) ([]float64, error) {
+	if fromRate == p.SampleRate {
+		return samples, nil
+	}
+	r, err := p.NewResampler(fromRate)
+	if err != nil {
+		return nil, err
+	}
+	samples = resample.Run(r, samples)
+	return samples, resample.Err(r)
+}
+
+// NewSpectrogramStream returns a stream computing the profile's spectrogram
+// of audio at p.SampleRate.
+func (p FingerprintProfile) NewSpectrogramStream() *SpectrogramStream {
+	if p.Resampler != ResamplerSinc {
+		return newSpectrogramStream(p.SampleRate, p.CutoffHz, p.DSPRatio, p.FreqBinSize, p.HopSize)
+	}
+	return newSincSpectrogramStream(p.SampleRate, p.CutoffHz, p.DSPRatio, p.FreqBinSize, p.HopSize)
+}
+
+// NewPeakFinder returns a PeakFinder for the frames of p.NewSpectrogramStream.
+func (p FingerprintProfile) NewPeakFinder() *PeakFinder {
+	width := p.FreqBinSize / 2
+	return &PeakFinder{
+		width:    width,
+		bands:    getLogBands(p.MaxBandHz, p.MinBandHz, p.NumBands, float64(width)),
+		distTime: p.PeakDistTime,
+		distFreq: p.PeakDistFreq,
+	}
+}
+
+// Peaks returns the constellation peaks of samples at p.SampleRate.
+func (p FingerprintProfile) Peaks(samples []float64) ([]models.Peak, error) {
+	return streamPeaks(p.NewSpectrogramStream(), p.NewPeakFinder(), samples, nil, nil)
+}
+
+// TimedPeaks is Peaks recording in timings how long the spectrogram and the
+// peak picking took.
+func (p FingerprintProfile) TimedPeaks(samples []float64, timings *PeakTimings) ([]models.Peak, error) {
+	return streamPeaks(p.NewSpectrogramStream(), p.NewPeakFinder(), samples, nil, timings)
+}
+
+// Analyze is Peaks passing every spectrogram frame to onFrame on the way, for
+// inspecting what the pipeline saw.
+func (p FingerprintProfile) Analyze(samples []float64, onFrame func(Frame)) ([]models.Peak, error) {
+	return streamPeaks(p.NewSpectrogramStream(), p.NewPeakFinder(), samples, onFrame, nil)
+}
+
+// Fingerprint is Fingerprint with the profile's target zone.
+func (p FingerprintProfile) Fingerprint(peaks []models.Peak, songID string) (map[uint32][]models.Couple, int) {
+	return fingerprint(peaks, songID, p.TargetZoneSize, uint32(p.MaxDeltaMs), p.Version == 1)
+}
+
+// WithDefaults returns p with the settings it leaves unset taken from base.
+func (p FingerprintProfile) WithDefaults(base FingerprintProfile) FingerprintProfile {
+	if p.Version == 0 {
+		p.Version = base.Version
+	}
+	if p.Resampler == "" {
+		p.Resampler = base.Resampler
+	}
+	return p
+}
+
+// CheckProfile compares the profile recorded with store to p and returns p
+// with its unset settings taken from the store's profile, or from
+// DefaultProfile for a new store. A store without a profile gets p recorded,
+// unless it already holds couples, which were made before profiles existed
+// with LegacyProfile. A mismatch is reported as ErrProfileMismatch naming the
+// parameters that differ.
+func CheckProfile(store db.Store, p FingerprintProfile) (FingerprintProfile, error) {
+	data, err := store.Profile()
+	if err != nil {
+		return p, err
+	}
+
+	var stored FingerprintProfile
+	if data == nil {
+		empty := true
+		err := store.Scan(func(address uint32, couples []models.Couple) error {
+			if len(couples) > 0 {
+				empty = false
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopScan) {
+			return p, err
+		}
+
+		if empty {
+			stored = p.WithDefaults(DefaultProfile())
+		} else {
+			stored = LegacyProfile()
+		}
+	} else if err := json.Unmarshal(data, &stored); err != nil {
+		return p, fmt.Errorf("stored fingerprint profile: %v", err)
+	}
+
+	p = p.WithDefaults(stored)
+	if err := p.Validate(); err != nil {
+		return p, err
+	}
+	if diff := profileDiff(stored, p); len(diff) > 0 {
+		return p, fmt.Errorf("%w: store %s, configured %s, differing in %v; re-ingest into a new store to change the profile",
+			ErrProfileMismatch, stored.ID(), p.ID(), diff)
+	}
+
+	if data == nil {
+		data, err := json.Marshal(stored)
+		if err != nil {
+			return p, err
+		}
+		return p, store.SetProfile(data)
+	}
+	return p, nil
+}
+
+var errStopScan = errors.New("stop scan")
+
+// profileDiff lists the fields that differ between a and b.
+func profileDiff(a, b FingerprintProfile) []string {
+	var diff []string
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	for i := 0; i < va.NumField(); i++ {
+		if va.Field(i).Interface() != vb.Field(i).Interface() {
+			diff = append(diff, fmt.Sprintf("%s %v != %v", va.Type().Field(i).Name, va.Field(i).Interface(), vb.Field(i).Interface()))
+		}
+	}
+	return diff
+}
@@ -2,7 +2,6 @@ package zham
 
 import (
 	"errors"
-	"fmt"
 	"math"
 	"math/cmplx"
 	"sort"
@@ -74,56 +73,6 @@ func DownSample(input []float64, sampleRate int) ([]float64, float64, error) {
 	return resampled, newSampleRate, nil
 }
 
-func Spectrogram(sample []float64, sampleRate int) ([][]float64, []float64, error) {
-	// using wav sample rate as 48KHz, and we will downsample(48kHz / 4) to 12kHz, so max freq is 12Khz / 2 = 6KHz
-	filteredSignal := LowPassFilter(maxFreq, float64(sampleRate), sample)
-
-	samples, newSampleRate, err := DownSample(filteredSignal, sampleRate)
-	if err != nil {
-		return nil, nil, fmt.Errorf("could not downsample audio sample: %v", err)
-	}
-
-	numWindows := int((len(samples) - freqBinSize) / hopSize)
-
-	spectrogramMags := make([][]float64, numWindows)
-	time := make([]float64, numWindows)
-	window := make([]float64, freqBinSize)
-
-	for i := range window {
-		window[i] = 0.54 - (0.46 * math.Cos(2*math.Pi*float64(i)/(float64(freqBinSize)-1)))
-	}
-
-	for i := range time {
-		start := i * hopSize
-		end := min(start+freqBinSize, len(samples))
-
-		bin := make([]float64, freqBinSize)
-		copy(bin, samples[start:end])
-
-		for j := range window {
-			bin[j] *= window[j]
-		}
-
-		spectrogramBin := FFT(bin)
-
-		binMags := make([]float64, freqBinSizeHalf)
-		for fi, freq := range spectrogramBin {
-			if fi < freqBinSizeHalf {
-				mag := cmplx.Abs(freq)
-				scaledMag := 20.0 * math.Log10(max(mag, 1e-10)) // scaled to dB
-				binMags[fi] = scaledMag
-			} else {
-				break
-			}
-		}
-
-		spectrogramMags[i] = binMags
-		time[i] = float64(start) / newSampleRate
-	}
-
-	return spectrogramMags, time, nil
-}
-
 type Bands struct{ min, max int32 }
 
 func getLogBands(max_freq float64, min_freq float64, num_bands int, L float64) []Bands {
@@ -150,96 +99,183 @@ func getLogBands(max_freq float64, min_freq float64, num_bands int, L float64) [
 	return bands
 }
 
-func GetPeaks(spectrogram [][]float64, time []float64, dist_time int, dist_freq int, coeff int) []models.Peak {
-
-	type maxStruct struct {
-		maxFreqAmplitude float64
-		Freq             int32
-		Time             float64
-	}
+type bandMax struct {
+	maxFreqAmplitude float64
+	Freq             int32
+	Time             float64
+}
 
-	N := len(spectrogram)
-	K := len(spectrogram[0])
+// localMax is a cell of the band maxima that dominates its neighbourhood, a
+// peak if it also clears the threshold. Cells in the padding past the last
+// band have no peak of their own and a zero magnitude.
+type localMax struct {
+	frame int
+	mag   float64
+	peak  models.Peak
+}
 
-	bands := getLogBands(6000.0, 300.0, 30, float64(K))
-	E := make([][]maxStruct, N)
-	var peaks []models.Peak
+// PeakFinder picks constellation peaks from spectrogram frames fed one at a
+// time. Each frame is reduced to its band maxima, and only those of the last
+// 2×distTime frames are kept, as far as the neighbourhood a peak has to
+// dominate reaches. The threshold a peak has to clear is the mean plus one
+// standard deviation of every local maximum of the audio though, so those are
+// kept until Peaks: memory grows by the few local maxima of each frame rather
+// than by the frames themselves.
+type PeakFinder struct {
+	width    int
+	bands    []Bands
+	distTime int
+	distFreq int
+
+	// window holds the band maxima of the frames from offset on
+	window [][]bandMax
+	offset int
+	frames int
+
+	// maxima are the local maxima of the frames before done, whose
+	// neighbourhoods are complete, and sum and num their running totals
+	maxima []localMax
+	done   int
+	sum    float64
+	num    int
+}
 
-	for i, bin := range spectrogram {
-		bandsEnergies := make([]maxStruct, len(bin))
-		for bi, band := range bands {
-			var maxMag maxStruct
-			for pos := band.min; pos < band.max; pos++ {
-				mag := bin[pos]
-				if mag > maxMag.maxFreqAmplitude {
-					maxMag = maxStruct{mag, pos, time[i]}
-				}
+func (p *PeakFinder) Add(frame Frame) {
+	bandsEnergies := make([]bandMax, len(p.bands))
+	for bi, band := range p.bands {
+		var maxMag bandMax
+		for pos := band.min; pos < band.max; pos++ {
+			mag := frame.Magnitudes[pos]
+			if mag > maxMag.maxFreqAmplitude {
+				maxMag = bandMax{mag, pos, frame.Time}
 			}
-			bandsEnergies[bi] = maxMag
 		}
-		E[i] = bandsEnergies
+		bandsEnergies[bi] = maxMag
 	}
+	p.window = append(p.window, bandsEnergies)
+	p.frames++
 
-	K = len(E[0])
-	C := make([][]bool, N)
-
-	for s := range C {
-		C[s] = make([]bool, K)
+	// a frame's neighbourhood ends distTime frames after it
+	for ; p.done+p.distTime <= p.frames; p.done++ {
+		p.maxima = p.localMaxima(p.done, p.frames, p.maxima, &p.sum, &p.num)
+	}
+	if drop := p.done - p.distTime - p.offset; drop > 0 {
+		p.window = append(p.window[:0], p.window[drop:]...)
+		p.offset += drop
 	}
+}
+
+// Frames returns how many frames have been added.
+func (p *PeakFinder) Frames() int {
+	return p.frames
+}
+
+// columns returns how many columns of a frame are checked for local maxima,
+// and how many past those are padding that always qualifies.
+func (p *PeakFinder) columns() (checked int, padded int) {
+	// Each frame's band maxima have always been padded with zero entries up
+	// to the frame width and those zeros count towards the mean and deviation
+	// in Peaks, so the stored fingerprints depend on them. Padding columns
+	// more than distFreq past the last band only see zero neighbours and
+	// always qualify, so they are counted rather than stored.
+	checked = min(p.width, len(p.bands)+p.distFreq)
+	return checked, p.width - checked
+}
 
-	sum := 0.0
-	num := 0
+// localMaxima appends the local maxima of frame n, among the first frames
+// frames, to maxima and adds them to sum and num.
+func (p *PeakFinder) localMaxima(n, frames int, maxima []localMax, sum *float64, num *int) []localMax {
+	K := p.width
+	numBands := len(p.bands)
+	checked, padded := p.columns()
 
-	for n, bin := range E {
-		for k := range bin {
-			mag := bin[k].maxFreqAmplitude
-			startN := max(0, n-dist_time)
-			endN := min(N, n+dist_time)
+	at := func(n, k int) float64 {
+		if k < numBands {
+			return p.window[n-p.offset][k].maxFreqAmplitude
+		}
+		return 0
+	}
 
-			startK := max(0, k-dist_freq)
-			endK := min(K, k+dist_freq)
+	for k := 0; k < checked; k++ {
+		mag := at(n, k)
+		startN := max(0, n-p.distTime)
+		endN := min(frames, n+p.distTime)
 
-			ok := true
+		startK := max(0, k-p.distFreq)
+		endK := min(K, k+p.distFreq)
 
-			for i := startN; i < endN; i++ {
-				for j := startK; j < endK; j++ {
-					if i != n && j != k && E[i][j].maxFreqAmplitude > mag {
-						ok = false
-						break
-					}
-				}
-				if !ok {
+		ok := true
+
+		for i := startN; i < endN; i++ {
+			for j := startK; j < endK; j++ {
+				if i != n && j != k && at(i, j) > mag {
+					ok = false
 					break
 				}
 			}
+			if !ok {
+				break
+			}
+		}
 
-			if ok {
-				C[n][k] = true
-				sum += mag
-				num++
+		if ok {
+			local := localMax{frame: n, mag: mag}
+			if k < numBands {
+				ref := p.window[n-p.offset][k]
+				local.peak = models.Peak{Time: ref.Time, Freq: ref.Freq}
 			}
+			maxima = append(maxima, local)
+			*sum += mag
+			*num++
 		}
 	}
+	*num += padded
+
+	return maxima
+}
+
+// Peaks returns the peaks of the frames added so far, which may be called
+// again after adding more.
+func (p *PeakFinder) Peaks() []models.Peak {
+	_, padded := p.columns()
+
+	// the last frames' neighbourhoods are cut short by the end of the audio
+	maxima := p.maxima[:len(p.maxima):len(p.maxima)]
+	sum, num := p.sum, p.num
+	for n := p.done; n < p.frames; n++ {
+		maxima = p.localMaxima(n, p.frames, maxima, &sum, &num)
+	}
+
+	if num == 0 {
+		return nil
+	}
 
 	mean := sum / float64(num)
 	stdDev := 0.0
-	for n, bin := range C {
-		for k := range bin {
-			if bin[k] {
-				stdDev += math.Pow(E[n][k].maxFreqAmplitude-mean, 2)
-			}
+	paddedDev := math.Pow(0-mean, 2)
+	i := 0
+	for n := 0; n < p.frames; n++ {
+		for ; i < len(maxima) && maxima[i].frame == n; i++ {
+			stdDev += math.Pow(maxima[i].mag-mean, 2)
+		}
+		for k := 0; k < padded; k++ {
+			stdDev += paddedDev
 		}
 	}
 	stdDev = math.Sqrt(stdDev / float64(num))
 	avg := mean + stdDev
 
-	for n, bin := range C {
-		for k := range bin {
-			if bin[k] {
-				ref := E[n][k]
-				if ref.maxFreqAmplitude >= avg {
-					peaks = append(peaks, models.Peak{Time: ref.Time, Freq: ref.Freq})
-				}
+	var peaks []models.Peak
+	i = 0
+	for n := 0; n < p.frames; n++ {
+		for ; i < len(maxima) && maxima[i].frame == n; i++ {
+			if maxima[i].mag >= avg {
+				peaks = append(peaks, maxima[i].peak)
+			}
+		}
+		if avg <= 0 {
+			for k := 0; k < padded; k++ {
+				peaks = append(peaks, models.Peak{})
 			}
 		}
 	}
@@ -0,0 +1,231 @@
+package zham
+
+import (
+	"math"
+	"math/cmplx"
+	"sync"
+	"time"
+	"zham-app/models"
+	"zham-app/resample"
+)
+
+// Frame is a single spectrogram column: the dB magnitudes of one analysis
+// window and the time (in seconds) at which the window starts.
+type Frame struct {
+	Time       float64
+	Magnitudes []float64
+}
+
+// SpectrogramStream computes the spectrogram frames of audio written to it in
+// chunks. The low-pass filter, the downsampling group and the window overlap
+// are carried across Write calls, so only about one window of audio is held at
+// a time as long as frames are drained with Next.
+type SpectrogramStream struct {
+	// decimator, when set, replaces the one-pole filter and the group
+	// averages below
+	decimator resample.Resampler
+
+	alpha      float64
+	prev       float64
+	ratio      int
+	newRate    float64
+	groupSum   float64
+	groupCount int
+
+	binSize int
+	hop     int
+
+	buf      []float64 // downsampled samples not yet consumed by a frame
+	offset   int       // index of buf[0] in the downsampled signal
+	window   []float64
+	windowed []float64
+	fftBuf   []complex128
+	plan     *RealFFTPlan
+}
+
+// realFFTPlans caches one RealFFTPlan per size. Its tables are read only, so
+// streams share them and only get a scratch buffer of their own.
+var realFFTPlans sync.Map
+
+func realFFTPlanFor(n int) *RealFFTPlan {
+	if plan, ok := realFFTPlans.Load(n); ok {
+		return plan.(*RealFFTPlan).clone()
+	}
+
+	plan, err := NewRealFFTPlan(n)
+	if err != nil {
+		panic(err)
+	}
+	actual, _ := realFFTPlans.LoadOrStore(n, plan)
+	return actual.(*RealFFTPlan).clone()
+}
+
+func newSpectrogramStream(sampleRate int, cutoffHz float64, ratio int, binSize int, hop int) *SpectrogramStream {
+	rc := 1.0 / (2 * math.Pi * cutoffHz)
+	dt := 1.0 / float64(sampleRate)
+
+	return &SpectrogramStream{
+		alpha:    dt / (rc + dt),
+		ratio:    ratio,
+		newRate:  float64(sampleRate) / float64(ratio),
+		binSize:  binSize,
+		hop:      hop,
+		window:   hammingWindow(binSize),
+		windowed: make([]float64, binSize),
+		fftBuf:   make([]complex128, binSize/2+1),
+		plan:     realFFTPlanFor(binSize),
+	}
+}
+
+// newSincSpectrogramStream is newSpectrogramStream decimating with a
+// windowed-sinc low-pass at cutoffHz, which unlike the one-pole filter keeps
+// what lies above the new Nyquist frequency from aliasing into the bands.
+func newSincSpectrogramStream(sampleRate int, cutoffHz float64, ratio int, binSize int, hop int) *SpectrogramStream {
+	s := newSpectrogramStream(sampleRate, cutoffHz, ratio, binSize, hop)
+	s.decimator = resample.NewSinc(sampleRate, sampleRate/ratio, cutoffHz)
+	return s
+}
+
+// Write filters and downsamples a chunk of mono samples into the stream.
+func (s *SpectrogramStream) Write(samples []float64) (int, error) {
+	if s.decimator != nil {
+		s.buf = append(s.buf, s.decimator.Write(samples)...)
+		return len(samples), nil
+	}
+
+	for _, x := range samples {
+		s.prev = s.alpha*x + (1-s.alpha)*s.prev
+
+		s.groupSum += s.prev
+		s.groupCount++
+		if s.groupCount == s.ratio {
+			s.push()
+		}
+	}
+
+	return len(samples), nil
+}
+
+// Flush pushes the last, partially filled downsampling group. Call it once
+// after the final Write.
+func (s *SpectrogramStream) Flush() {
+	if s.decimator != nil {
+		s.buf = append(s.buf, s.decimator.Flush()...)
+		return
+	}
+	if s.groupCount > 0 {
+		s.push()
+	}
+}
+
+func (s *SpectrogramStream) push() {
+	s.buf = append(s.buf, s.groupSum/float64(s.groupCount))
+	s.groupSum = 0
+	s.groupCount = 0
+}
+
+// Next returns the next frame once enough audio has been written. A frame is
+// only emitted when the following hop is available too, which keeps the
+// number of windows, and so the fingerprints, of the original batch
+// spectrogram.
+func (s *SpectrogramStream) Next() (Frame, bool) {
+	if len(s.buf) < s.binSize+s.hop {
+		return Frame{}, false
+	}
+
+	frame := Frame{
+		Time:       float64(s.offset) / s.newRate,
+		Magnitudes: s.windowMagnitudes(s.buf[:s.binSize]),
+	}
+
+	s.buf = s.buf[s.hop:]
+	s.offset += s.hop
+
+	// compact once the consumed prefix outgrows the live window
+	if cap(s.buf) > 4*s.binSize && len(s.buf) < s.binSize*2 {
+		s.buf = append(make([]float64, 0, s.binSize*2), s.buf...)
+	}
+
+	return frame, true
+}
+
+func hammingWindow(size int) []float64 {
+	window := make([]float64, size)
+	for i := range window {
+		window[i] = 0.54 - (0.46 * math.Cos(2*math.Pi*float64(i)/(float64(size)-1)))
+	}
+	return window
+}
+
+// windowMagnitudes windows bin and returns the dB magnitudes of the lower
+// half of its spectrum.
+func (s *SpectrogramStream) windowMagnitudes(bin []float64) []float64 {
+	for j, w := range s.window {
+		s.windowed[j] = bin[j] * w
+	}
+
+	s.plan.Transform(s.windowed, s.fftBuf)
+
+	binMags := make([]float64, s.binSize/2)
+	for fi := range binMags {
+		mag := cmplx.Abs(s.fftBuf[fi])
+		binMags[fi] = 20.0 * math.Log10(max(mag, 1e-10)) // scaled to dB
+	}
+
+	return binMags
+}
+
+// PeakTimings splits the time taken to find the peaks of some audio between
+// computing its spectrogram and picking the peaks from it.
+type PeakTimings struct {
+	Spectrogram time.Duration
+	Peaks       time.Duration
+}
+
+// streamPeaks feeds samples through stream in small chunks and hands every
+// frame to finder straight away, so the full magnitude matrix is never held
+// in memory. onFrame, if not nil, sees every frame before it is reduced, and
+// timings, if not nil, is set to where the time went. ErrTooShort is returned
+// when the audio doesn't fill a single analysis window.
+func streamPeaks(stream *SpectrogramStream, finder *PeakFinder, samples []float64, onFrame func(Frame), timings *PeakTimings) ([]models.Peak, error) {
+	const chunkSize = 1 << 14
+
+	var spent PeakTimings
+	mark := time.Now()
+	lap := func(stage *time.Duration) {
+		now := time.Now()
+		*stage += now.Sub(mark)
+		mark = now
+	}
+
+	drain := func() {
+		for frame, ok := stream.Next(); ok; frame, ok = stream.Next() {
+			lap(&spent.Spectrogram)
+			if onFrame != nil {
+				onFrame(frame)
+			}
+			finder.Add(frame)
+			lap(&spent.Peaks)
+		}
+		lap(&spent.Spectrogram)
+	}
+
+	for start := 0; start < len(samples); start += chunkSize {
+		stream.Write(samples[start:min(start+chunkSize, len(samples))])
+		drain()
+	}
+
+	stream.Flush()
+	drain()
+
+	if finder.Frames() == 0 {
+		return nil, ErrTooShort
+	}
+
+	peaks := finder.Peaks()
+	lap(&spent.Peaks)
+	if timings != nil {
+		*timings = spent
+	}
+	return peaks, nil
+}
@@ -1,39 +1,132 @@
 package zham
 
 import (
+	"errors"
 	"math"
 	"sort"
 	"zham-app/db"
 	"zham-app/models"
 )
 
-type diffStruct struct {
+var (
+	// ErrTooShort is returned when the audio is shorter than one spectrogram window.
+	ErrTooShort = errors.New("zham: audio too short to fingerprint")
+	// ErrNoFingerprints is returned when the audio yields no fingerprints, as
+	// with silence or very short clips.
+	ErrNoFingerprints = errors.New("zham: no fingerprints found in audio")
+)
+
+// MatchConfig tunes how FindMatches scores candidates.
+type MatchConfig struct {
+	// WindowMs is the width of the offset histogram windows.
+	WindowMs int
+	// ZThreshold is the z-score of the best offset window above which a song
+	// counts as a match rather than a weak candidate.
+	ZThreshold float64
+	// MaxCandidates caps how many songs FindMatches returns.
+	MaxCandidates int
+}
+
+func DefaultMatchConfig() MatchConfig {
+	return MatchConfig{WindowMs: 100, ZThreshold: 2.5, MaxCandidates: 10}
+}
+
+// Match is a candidate song for a query.
+type Match struct {
+	SongID string
+	// Score is the share of the query's hashes that line up with the song
+	// at the best offset, between 0 and 1.
+	Score float64
+	// Z is the z-score of the best offset window in the song's histogram.
+	Z float64
+	// AlignedHashes is the number of hashes in the best offset window.
+	AlignedHashes int
+	// OffsetSec is where in the reference track the query snippet starts. A
+	// query starting before the track, e.g. recorded with a lead-in, would
+	// have a negative offset and gets 0 instead.
+	OffsetSec float64
+	// Confident is set when Z reaches the match threshold.
+	Confident bool
+
+	// windowCount is the histogram count of the best window, which weak
+	// candidates have always been ranked by.
+	windowCount int
+	aligned     map[QueryHash]bool
+	debug       MatchDebug
+}
+
+// MatchDebug is how FindMatches scored a candidate, for analysing the matcher.
+type MatchDebug struct {
+	// Offsets is the histogram of the song's anchor times minus the query's
+	// over the hashes they share, ordered by Diff.
+	Offsets []OffsetCount
+	// WindowStart is the start of the densest window of Offsets, and
+	// MaxCount, Mean, StdDev and Z the statistics of the window counts
+	// Confident is decided by.
+	WindowStart int
+	MaxCount    int
+	Mean        float64
+	StdDev      float64
+	Z           float64
+}
+
+// Debug returns how the candidate was scored.
+func (m Match) Debug() MatchDebug {
+	return m.debug
+}
+
+// QueryHash is one hash of the query: the address of an anchor/target pair
+// and the anchor's time in the query.
+type QueryHash struct {
+	Address      uint32
+	AnchorTimeMs uint32
+}
+
+// Aligned returns the query hashes that line up with the song at the best
+// offset, the ones AlignedHashes counts, ordered by anchor time.
+func (m Match) Aligned() []QueryHash {
+	hashes := make([]QueryHash, 0, len(m.aligned))
+	for hash := range m.aligned {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if hashes[i].AnchorTimeMs != hashes[j].AnchorTimeMs {
+			return hashes[i].AnchorTimeMs < hashes[j].AnchorTimeMs
+		}
+		return hashes[i].Address < hashes[j].Address
+	})
+	return hashes
+}
+
+// OffsetCount is a bar of an offset histogram: Count query hashes put the
+// query Diff ms into the song.
+type OffsetCount struct {
 	Diff  int
 	Count int
 }
 
-// remove in prod
-// type ColabBody struct {
-// 	Offsets []diffStruct `json:"Offsets"`
-// 	SongID  string       `json:"SongID"`
-// }
-// //
-
-// func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int, numTargetZones int) ([]string, []ColabBody, error) {
-func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int, numTargetZones int) ([]string, error) {
+// FindMatches returns up to cfg.MaxCandidates candidate songs for the query
+// fingerprints.
+// Confident matches come first, ordered by z-score, followed by the weaker
+// candidates ordered by aligned hashes. A result without a Confident entry
+// means no song passed the threshold.
+func FindMatches(store db.Store, fingerprints map[uint32][]models.Couple, sizeOfTargetZone int, numTargetZones int, cfg MatchConfig) ([]Match, error) {
+	if len(fingerprints) == 0 {
+		return nil, ErrNoFingerprints
+	}
 
 	addresses := []uint32{}
 	for address := range fingerprints {
 		addresses = append(addresses, address)
 	}
 
-	m, err := db.GetCouples(addresses)
+	m, err := store.Lookup(addresses)
 	if err != nil {
-		// return nil, nil, err
 		return nil, err
 	}
 
 	type matchesStruct struct {
+		address     uint32
 		sampleTimes []models.Couple
 		dbTime      uint32
 	}
@@ -74,7 +167,7 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 					}
 					matches[cSongID] = append(
 						matches[cSongID],
-						matchesStruct{sampleTimes: fingerprints[AddressCouples.Address], dbTime: cAnchorTimeMs},
+						matchesStruct{address: AddressCouples.Address, sampleTimes: fingerprints[AddressCouples.Address], dbTime: cAnchorTimeMs},
 					)
 				}
 			}
@@ -84,19 +177,8 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 	// targetCoefficient := 0.6
 	// threshold := int(targetCoefficient * float64(numTargetZones))
 
-	type bestStruct struct {
-		SongId   string
-		maxCount float64
-	}
-	type padStruct struct {
-		SongId   string
-		maxCount int
-	}
-
-	var bestMatch []bestStruct
-	var paddedMatch []padStruct
-
-	// offsets := []ColabBody{}
+	var bestMatch []Match
+	var paddedMatch []Match
 
 	for songID, anchorZones := range targetZones {
 		// fmt.Println("songId and anchorZones len", songID, len(anchorZones), threshold)
@@ -109,7 +191,9 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 			for _, mtch := range match {
 				mpS := map[int]int{}
 				for _, sTime := range mtch.sampleTimes {
-					diff := int(mtch.dbTime - sTime.AnchorTimeMs)
+					// through int32 so a sample anchor later than the db anchor
+					// gives a negative diff instead of wrapping around
+					diff := int(int32(mtch.dbTime - sTime.AnchorTimeMs))
 					mpS[diff]++
 				}
 
@@ -118,10 +202,10 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 				}
 			}
 
-			arr := make([]diffStruct, len(mp))
+			arr := make([]OffsetCount, len(mp))
 			index := 0
 			for diff, count := range mp {
-				arr[index] = diffStruct{Diff: diff, Count: count}
+				arr[index] = OffsetCount{Diff: diff, Count: count}
 				index++
 			}
 
@@ -129,21 +213,13 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 				return arr[i].Diff < arr[j].Diff
 			})
 
-			// remove in prod
-			// var cBody ColabBody
-			// cBody.Offsets = arr
-			// cBody.SongID = songID
-
-			// offsets = append(offsets, cBody)
-			//
-
-			// compute ranges(of length 100) for each diff, for histogram
+			// compute ranges(of length cfg.WindowMs) for each diff, for histogram
 			mpD := map[int]int{}
 
 			for i := range arr {
 				cnt := 0
 				for j := i; j < len(arr); j++ {
-					if math.Abs(float64(arr[j].Diff-arr[i].Diff)) > 100.0 { // 10
+					if math.Abs(float64(arr[j].Diff-arr[i].Diff)) > float64(cfg.WindowMs) { // 10
 						break
 					}
 					cnt += arr[j].Count
@@ -152,50 +228,87 @@ func FindMatches(fingerprints map[uint32][]models.Couple, sizeOfTargetZone int,
 				mpD[arr[i].Diff] = cnt
 			}
 
-			maxCnt, _, _, z := calculateStats(mpD)
+			maxCnt, mean, stdDev, z := calculateStats(mpD)
 			// fmt.Println("song, scores", songID, maxCnt, mean, stdDev, z)
-			if z >= 2.5 {
-				bestMatch = append(bestMatch, bestStruct{SongId: songID, maxCount: z})
+
+			windowStart, offset := bestOffset(arr, mpD, cfg.WindowMs)
+
+			// count the distinct query hashes that agree with the best window
+			aligned := map[QueryHash]bool{}
+			for _, mtch := range match {
+				for _, sTime := range mtch.sampleTimes {
+					diff := int(int32(mtch.dbTime - sTime.AnchorTimeMs))
+					if diff >= windowStart && diff-windowStart <= cfg.WindowMs {
+						aligned[QueryHash{mtch.address, sTime.AnchorTimeMs}] = true
+					}
+				}
+			}
+
+			candidate := Match{
+				SongID:        songID,
+				Score:         min(1.0, float64(len(aligned))/float64(max(numTargetZones, 1))),
+				Z:             z,
+				AlignedHashes: len(aligned),
+				OffsetSec:     float64(max(offset, 0)) / 1000.0,
+				Confident:     z >= cfg.ZThreshold,
+				windowCount:   maxCnt,
+				aligned:       aligned,
+				debug: MatchDebug{
+					Offsets:     arr,
+					WindowStart: windowStart,
+					MaxCount:    maxCnt,
+					Mean:        mean,
+					StdDev:      stdDev,
+					Z:           z,
+				},
+			}
+			if candidate.Confident {
+				bestMatch = append(bestMatch, candidate)
 			} else {
-				paddedMatch = append(paddedMatch, padStruct{SongId: songID, maxCount: maxCnt})
+				paddedMatch = append(paddedMatch, candidate)
 			}
 
 		}
 	}
 
 	sort.Slice(bestMatch, func(i, j int) bool {
-		return bestMatch[i].maxCount > bestMatch[j].maxCount
+		return bestMatch[i].Z > bestMatch[j].Z
 	})
 
 	sort.Slice(paddedMatch, func(i, j int) bool {
-		return paddedMatch[i].maxCount > paddedMatch[j].maxCount
+		return paddedMatch[i].windowCount > paddedMatch[j].windowCount
 	})
 
-	res := make([]string, 10)
-	rem := 0
+	res := append(bestMatch, paddedMatch...)
+	if len(res) > cfg.MaxCandidates {
+		res = res[:cfg.MaxCandidates]
+	}
+
+	return res, nil
 
-	for _, val := range bestMatch {
-		if rem < 10 {
-			// fmt.Println("bestMatch max count", val.SongId, val.maxCount)
-			// res = append(res, val.SongId)
-			res[rem] = val.SongId
-			rem++
+}
+
+// bestOffset returns the start of the densest window ms wide of the offset
+// histogram and the most common diff (in ms) inside it. arr is sorted by diff
+// and windows maps each diff to the count of the window starting at it.
+func bestOffset(arr []OffsetCount, windows map[int]int, window int) (int, int) {
+	best := -1
+	for i := range arr {
+		if best < 0 || windows[arr[i].Diff] > windows[arr[best].Diff] {
+			best = i
 		}
 	}
+	if best < 0 {
+		return 0, 0
+	}
 
-	if rem < 10 {
-		for _, score := range paddedMatch {
-			if rem < 10 {
-				// fmt.Println("paddedMatch max count", score.SongId, score.maxCount)
-				res[rem] = score.SongId
-				rem++
-			}
+	mode := arr[best]
+	for j := best; j < len(arr) && arr[j].Diff-arr[best].Diff <= window; j++ {
+		if arr[j].Count > mode.Count {
+			mode = arr[j]
 		}
 	}
-
-	// return res, offsets, nil
-	return res, nil
-
+	return arr[best].Diff, mode.Diff
 }
 
 func calculateStats(data map[int]int) (int, float64, float64, float64) {
@@ -215,7 +328,11 @@ func calculateStats(data map[int]int) (int, float64, float64, float64) {
 	}
 	stdDev = math.Sqrt(stdDev / float64(n))
 
+	// a flat histogram has no outlier, and NaN can't be encoded as JSON
 	z := 0.0
+	if stdDev == 0 {
+		return maxCnt, mean, stdDev, z
+	}
 	for _, cnt := range data {
 		z = max(z, (float64(cnt)-mean)/stdDev)
 	}
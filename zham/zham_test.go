@@ -0,0 +1,49 @@
+package zham
+
+import (
+	"math/rand"
+	"testing"
+
+	"zham-app/db"
+	"zham-app/models"
+)
+
+// TestMatchOffsetNotNegative queries with the song's peaks delayed by two
+// seconds, as if recorded with a lead-in, which puts the best offset before
+// the start of the song.
+func TestMatchOffsetNotNegative(t *testing.T) {
+	store, err := db.OpenDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	rng := rand.New(rand.NewSource(1))
+	var song, query []models.Peak
+	for i := 0; i < 400; i++ {
+		peak := models.Peak{Time: float64(i) * 0.025, Freq: int32(rng.Intn(1024))}
+		song = append(song, peak)
+		if peak.Time < 5 {
+			peak.Time += 2
+			query = append(query, peak)
+		}
+	}
+
+	p := DefaultProfile()
+	fingerprints, _ := p.Fingerprint(song, "song")
+	if err := store.Put(fingerprints); err != nil {
+		t.Fatal(err)
+	}
+
+	queryPrints, numTargetZones := p.Fingerprint(query, "")
+	matches, err := FindMatches(store, queryPrints, p.TargetZoneSize, numTargetZones, DefaultMatchConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) == 0 || matches[0].SongID != "song" {
+		t.Fatalf("matches = %+v, want song first", matches)
+	}
+	if matches[0].OffsetSec != 0 {
+		t.Errorf("OffsetSec = %v, want 0", matches[0].OffsetSec)
+	}
+}